@@ -0,0 +1,129 @@
+package flow
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// AdminHandler returns an HTTP handler to inspect and control this circuit
+// while it is running. It can be mounted anywhere, using http.StripPrefix:
+//
+//	GET  /circuit                  the description of the circuit, see Describe
+//	GET  /stats                    the current activity, see Stats
+//	GET  /metrics                  the same in Prometheus format, see WriteMetrics
+//	GET  /profile                  the results of profiling, see Profile
+//	GET  /registry                 all gadget types, with their pins
+//	POST /inject?pin=c.In&tag=t    send the JSON request body to a pin
+//	GET  /tap?pin=c.In             stream messages sent to a pin as JSON lines
+//	POST /abort                    abort the circuit
+//	POST /shutdown?timeout=5s      let the wires drain, then abort
+func (c *Circuit) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/circuit", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.Describe())
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.Stats())
+	})
+	mux.Handle("/metrics", c.MetricsHandler())
+	mux.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.Profile())
+	})
+	mux.HandleFunc("/registry", func(w http.ResponseWriter, r *http.Request) {
+		types := map[string][]string{}
+		for _, name := range registryNames() {
+			types[name], _ = typePins(name)
+		}
+		writeJSON(w, types)
+	})
+	mux.HandleFunc("/inject", func(w http.ResponseWriter, r *http.Request) {
+		if !isPost(w, r) {
+			return
+		}
+		var m Message
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tag := r.FormValue("tag"); tag != "" {
+			m = Tag{tag, m}
+		}
+		if err := c.Inject(r.FormValue("pin"), m); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/tap", func(w http.ResponseWriter, r *http.Request) {
+		tap, stop, err := c.Tap(r.FormValue("pin"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer stop()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush() // lets the client know that the tap is in place
+		}
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case m, ok := <-tap:
+				if !ok {
+					return // the wire has been closed
+				}
+				if err := enc.Encode(m); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) {
+		if isPost(w, r) {
+			c.Abort()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		if !isPost(w, r) {
+			return
+		}
+		timeout := 5 * time.Second
+		if s := r.FormValue("timeout"); s != "" {
+			var err error
+			if timeout, err = time.ParseDuration(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, map[string]bool{"drained": c.Shutdown(timeout)})
+	})
+	return mux
+}
+
+func isPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
@@ -0,0 +1,139 @@
+package flow_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+// Keeps its output open until stop is closed.
+type adminSource struct {
+	flow.Gadget
+	Out flow.Output
+
+	stop chan struct{}
+}
+
+func (g *adminSource) Run() {
+	<-g.stop
+}
+
+// Passes on everything it receives.
+type adminSink struct {
+	flow.Gadget
+	In flow.Input
+
+	got chan flow.Message
+}
+
+func (g *adminSink) Run() {
+	for m := range g.In {
+		g.got <- m
+	}
+	close(g.got)
+}
+
+func TestAdminHandler(t *testing.T) {
+	src := &adminSource{stop: make(chan struct{})}
+	sink := &adminSink{got: make(chan flow.Message, 10)}
+	sub := flow.NewCircuit()
+	sub.AddCircuitry("k", sink)
+	sub.Label("In", "k.In")
+	c := flow.NewCircuit()
+	c.AddCircuitry("s", src)
+	c.AddCircuitry("sub", sub)
+	c.Connect("s.Out", "sub.In", 0)
+	done := make(chan struct{})
+	go func() {
+		c.Run()
+		close(done)
+	}()
+
+	server := httptest.NewServer(c.AdminHandler())
+	defer server.Close()
+	request := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		flow.Check(err)
+		resp, err := http.DefaultClient.Do(req)
+		flow.Check(err)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		flow.Check(err)
+		return resp.StatusCode, string(data)
+	}
+
+	tap, err := http.Get(server.URL + "/tap?pin=sub.k.In")
+	flow.Check(err)
+	defer tap.Body.Close()
+
+	if code, body := request("POST", "/inject?pin=sub.In&tag=t", `{"a":1}`); code != 204 {
+		t.Fatalf("inject failed: %d %s", code, body)
+	}
+	expect := flow.Tag{"t", map[string]interface{}{"a": 1.0}}
+	if m := <-sink.got; !equalJSON(m, expect) {
+		t.Errorf("expected %v, got: %v", expect, m)
+	}
+	line, err := bufio.NewReader(tap.Body).ReadString('\n')
+	flow.Check(err)
+	if line != `{"Tag":"t","Msg":{"a":1}}`+"\n" {
+		t.Errorf("unexpected tap output: %q", line)
+	}
+
+	code, body := request("GET", "/stats", "")
+	var stats flow.Stats
+	flow.Check(json.Unmarshal([]byte(body), &stats))
+	if code != 200 || len(stats.Wires) != 1 || stats.Wires[0].To != "sub.In" ||
+		stats.Wires[0].Sent != 1 || stats.Gadgets[1].State != "running" {
+		t.Errorf("unexpected stats: %d %s", code, body)
+	}
+	if code, body := request("GET", "/registry", ""); code != 200 ||
+		!strings.Contains(body, `"Printer": [`) {
+		t.Errorf("unexpected registry: %d %s", code, body)
+	}
+	if code, body := request("GET", "/circuit", ""); code != 200 ||
+		!strings.Contains(body, `"from": "s.Out"`) {
+		t.Errorf("unexpected description: %d %s", code, body)
+	}
+
+	if code, _ := request("GET", "/abort", ""); code != 405 {
+		t.Errorf("expected 405, got: %d", code)
+	}
+	if code, body := request("POST", "/inject?pin=x.In", `1`); code != 404 {
+		t.Errorf("expected 404, got: %d %s", code, body)
+	}
+	if code, body := request("POST", "/shutdown?timeout=1s", ""); code != 200 ||
+		!strings.Contains(body, `"drained": true`) {
+		t.Errorf("unexpected shutdown: %d %s", code, body)
+	}
+	close(src.stop)
+	<-done
+
+	// the tap stream ends once the circuit has finished
+	ended := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(tap.Body)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Errorf("tap did not end cleanly: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("tap still open after Run returned")
+	}
+}
+
+func equalJSON(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
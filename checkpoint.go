@@ -0,0 +1,133 @@
+package flow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// A Stateful gadget can save its state and have it restored after a restart,
+// see Circuit.SetCheckpoints. Snapshot can be called while the gadget is
+// running, so it has to guard against concurrent changes to its state. Restore
+// is called before the gadget is started.
+type Stateful interface {
+	Snapshot() Message
+	Restore(state Message)
+}
+
+// Settings for saving and restoring the state of gadgets.
+type checkpoints struct {
+	dir      string
+	interval time.Duration
+}
+
+// SetCheckpoints enables saving the state of all Stateful gadgets in this
+// circuit and its sub-circuits as files in dir, at the given interval while the
+// circuit is running (zero means never), and once more when Run finishes. On
+// the next Run, these gadgets are restored from those files before starting.
+func (c *Circuit) SetCheckpoints(dir string, interval time.Duration) {
+	c.state = &checkpoints{dir, interval}
+}
+
+// Call a function for each Stateful gadget, with the path of its name.
+func (c *Circuit) eachStateful(prefix string, fn func(path string, s Stateful)) {
+	c.mu.Lock()
+	names := []string{}
+	for name := range c.gadgets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	gadgets := []Circuitry{}
+	for _, name := range names {
+		gadgets = append(gadgets, c.gadgets[name].circuitry)
+	}
+	c.mu.Unlock()
+
+	for i, g := range gadgets {
+		switch g := g.(type) {
+		case *Circuit:
+			g.eachStateful(prefix+names[i]+".", fn)
+		case Stateful:
+			fn(prefix+names[i], g)
+		}
+	}
+}
+
+// Checkpoint saves the state of all Stateful gadgets right away. This is only
+// possible once SetCheckpoints has been called.
+func (c *Circuit) Checkpoint() error {
+	if c.state == nil {
+		return nil
+	}
+	dir := c.state.dir
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	var firstErr error
+	c.eachStateful("", func(path string, s Stateful) {
+		data, err := Codecs["json"].Encode(s.Snapshot())
+		if err == nil {
+			// write to a temporary file first, so that a crash can't leave
+			// a partially written checkpoint behind
+			file := filepath.Join(dir, path+".json")
+			if err = ioutil.WriteFile(file+".tmp", data, 0666); err == nil {
+				err = os.Rename(file+".tmp", file)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	})
+	return firstErr
+}
+
+// Restore all Stateful gadgets for which a checkpoint has been saved.
+func (c *Circuit) restore() {
+	c.eachStateful("", func(path string, s Stateful) {
+		data, err := ioutil.ReadFile(filepath.Join(c.state.dir, path+".json"))
+		if os.IsNotExist(err) {
+			return
+		}
+		var state Message
+		if err == nil {
+			state, err = Codecs["json"].Decode(data)
+		}
+		if err != nil {
+			glog.Errorln("cannot restore", path+":", err)
+			return
+		}
+		s.Restore(state)
+	})
+}
+
+// Save checkpoints periodically, until the returned function is called.
+func (c *Circuit) saveCheckpoints() (stop func()) {
+	if c.state.interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(c.state.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := c.Checkpoint(); err != nil {
+					glog.Errorln("checkpoint:", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
@@ -0,0 +1,86 @@
+package flow_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func ExampleCircuit_SetCheckpoints() {
+	dir, err := ioutil.TempDir("", "flow")
+	flow.Check(err)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 2; i++ {
+		g := flow.NewCircuit()
+		g.Add("r", "Repeater")
+		g.Add("c", "Counter")
+		g.Add("p", "Printer")
+		g.Connect("r.Out", "c.In", 0)
+		g.Connect("c.Out", "p.In", 0)
+		g.Feed("r.Num", 3)
+		g.Feed("r.In", "abc")
+		g.SetCheckpoints(dir, 0)
+		g.Run()
+	}
+	// Output:
+	// 3
+	// 6
+}
+
+// Keeps running until it has been saved a few times.
+type checkpointed struct {
+	flow.Gadget
+	saves    int32
+	restored flow.Message
+}
+
+func (g *checkpointed) Run() {
+	for atomic.LoadInt32(&g.saves) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (g *checkpointed) Snapshot() flow.Message {
+	return int(atomic.AddInt32(&g.saves, 1))
+}
+
+func (g *checkpointed) Restore(state flow.Message) {
+	g.restored = state
+}
+
+func TestCheckpointInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	flow.Check(err)
+	defer os.RemoveAll(dir)
+
+	run := func(s *checkpointed) {
+		sub := flow.NewCircuit()
+		sub.AddCircuitry("s", s)
+		g := flow.NewCircuit()
+		g.AddCircuitry("sub", sub)
+		g.SetCheckpoints(dir, 5*time.Millisecond)
+		g.Run()
+	}
+
+	first := new(checkpointed)
+	run(first)
+	if first.restored != nil {
+		t.Errorf("nothing to restore yet, got: %v", first.restored)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub.s.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &checkpointed{saves: 3} // stops right away
+	run(second)
+	if second.restored != int(first.saves) {
+		t.Errorf("expected %d, got: %v", first.saves, second.restored)
+	}
+}
@@ -1,6 +1,7 @@
 package flow
 
 import (
+	"sort"
 	"strings"
 	"sync"
 
@@ -22,21 +23,32 @@ func NewCircuit() *Circuit {
 type Circuit struct {
 	Gadget
 
-	gnames  []gadgetDef          // gadgets added by name from the registry
-	gadgets map[string]*Gadget   // gadgets added to this circuit
-	wires   []wireDef            // list of all connections
-	feeds   map[string][]Message // message feeds
-	labels  map[string]string    // pin label lookup map
+	gnames  []gadgetDef            // gadgets added by name or from a definition
+	gadgets map[string]*Gadget     // gadgets added to this circuit
+	wires   []wireDef              // list of all connections
+	feeds   map[string][]Message   // message feeds
+	timed   map[string][]timedFeed // message feeds sent after the start
+	labels  map[string]string      // pin label lookup map
 
         abort   chan struct{}        // closing this channel aborts the circuit
         abortOnce *sync.Once         // ensure we only close the abort channel once
 	wait      sync.WaitGroup     // tracks number of running gadgets
+	running   bool               // set once Run has been called
+	mu        sync.Mutex         // guards against changes while launching
+	params    map[string]string  // values for placeholders in definitions
+	state     *checkpoints       // where to save the state of gadgets, if set
+	profile   *profile           // set when profiling is enabled
+	spares    map[string][]Circuitry // gadgets created while checking
 }
 
 // definition of one named gadget
 type gadgetDef struct {
-	Name string `json:"name"`
-	Type string `json:"type"`
+	Name     string            `json:"name"`
+	Type     string            `json:"type,omitempty"`
+	Replicas int               `json:"replicas,omitempty"`
+	Ordered  bool              `json:"ordered,omitempty"`
+	Circuit  *config           `json:"circuit,omitempty"` // inline sub-circuit
+	Params   map[string]string `json:"params,omitempty"`  // for definitions from a setup file
 }
 
 // definition of one connection
@@ -44,6 +56,10 @@ type wireDef struct {
 	From     string `json:"from"`
 	To       string `json:"to"`
 	Capacity int    `json:"capacity"`
+	Durable  string  `json:"durable,omitempty"` // file to queue messages in
+	Rate     float64 `json:"rate,omitempty"`    // messages per second, if limited
+	Burst    int     `json:"burst,omitempty"`   // messages above the rate
+	Drop     bool    `json:"drop,omitempty"`    // drop messages over the limit
 }
 
 // Add a named gadget to the circuit with a unique name.
@@ -53,8 +69,16 @@ func (c *Circuit) Add(name, gadget string) {
 		glog.Warningln("not found:", gadget)
 		return
 	}
-	c.gnames = append(c.gnames, gadgetDef{name, gadget})
-	c.AddCircuitry(name, constructor())
+	c.gnames = append(c.gnames, gadgetDef{Name: name, Type: gadget})
+	c.AddCircuitry(name, c.newGadget(gadget))
+}
+
+// Add a sub-circuit, as specified by an inline definition.
+func (c *Circuit) addSubCircuit(name string, def *config) {
+	sub := NewCircuit()
+	sub.loadConfig(def)
+	c.gnames = append(c.gnames, gadgetDef{Name: name, Circuit: def})
+	c.AddCircuitry(name, sub)
 }
 
 // Add a gadget or circuit to the circuit with a unique name.
@@ -93,9 +117,7 @@ func (c *Circuit) DestOf(from string) string {
 
 // Connect an output pin with an input pin.
 func (c *Circuit) Connect(from, to string, capacity int) {
-	c.wires = append(c.wires, wireDef{from, to, capacity})
-	w := c.gadgetOf(to).getInput(pinPart(to), capacity)
-	c.gadgetOf(from).setOutput(pinPart(from), w)
+	c.connect(wireDef{From: from, To: to, Capacity: capacity})
 }
 
 // Set up a message to feed to a gadget on startup.
@@ -113,14 +135,43 @@ func (c *Circuit) Label(external, internal string) {
 
 // Start up the circuit, and return when it is finished.
 func (c *Circuit) Run() {
+	if c.state != nil {
+		c.restore()
+		stop := c.saveCheckpoints()
+		defer func() {
+			stop()
+			if err := c.Checkpoint(); err != nil {
+				glog.Errorln("checkpoint:", err)
+			}
+		}()
+	}
+	if c.profile != nil {
+		c.prepareProfiling()
+	}
+	c.mu.Lock()
+	c.running = true
 	for _, g := range c.gadgets {
 		g.launch()
 	}
+	c.mu.Unlock()
 	c.wait.Wait()
+
+	// inputs can be left open when a gadget ends, but no more will be sent
+	c.mu.Lock()
+	for _, g := range c.gadgets {
+		for _, w := range g.inputs {
+			w.mu.Lock()
+			w.closeTaps()
+			w.mu.Unlock()
+		}
+	}
+	c.mu.Unlock()
 }
 
 // Start up one gadget in the circuit, useful after dynamically ading a gadget
 func (c *Circuit) RunGadget(name string) {
+        c.mu.Lock()
+        defer c.mu.Unlock()
         c.gadgets[name].launch()
 }
 
@@ -133,47 +184,73 @@ func (c *Circuit) Abort() {
         })
 }
 
-// Return a description of this circuit in serialisable form.
+// Return a description of this circuit in serialisable form. This is the same
+// format as used by LoadJSON, so the description can be loaded back in again.
+// Sub-circuits which are not in the registry are described inline, any other
+// gadgets which are not in the registry are only listed as "unregistered".
 func (c *Circuit) Describe() interface{} {
-	desc := map[string]interface{}{}
-	if len(c.gnames) > 0 {
-		desc["gadgets"] = c.gnames
-	}
-	if len(c.gadgets) > len(c.gnames) {
-		named := map[string]bool{}
-		for _, n := range c.gnames {
-			named[n.Name] = true
+	return c.describe()
+}
+
+func (c *Circuit) describe() *config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	desc := &config{}
+	named := map[string]bool{}
+	for _, d := range c.gnames {
+		if d.Circuit != nil {
+			d.Circuit = c.gadgets[d.Name].circuitry.(*Circuit).describe()
 		}
-		unreg := []string{}
-		for k := range c.gadgets {
-			if !named[k] {
-				unreg = append(unreg, k)
-			}
+		desc.Gadgets = append(desc.Gadgets, d)
+		named[d.Name] = true
+	}
+	unreg := []string{}
+	for k := range c.gadgets {
+		if !named[k] {
+			unreg = append(unreg, k)
 		}
-		desc["unregistered"] = unreg
-	}
-	if len(c.wires) > 0 {
-		desc["wires"] = c.wires
-	}
-	if len(c.feeds) > 0 {
-		expanded := []map[string]Message{}
-		for pin, feeds := range c.feeds {
-			for _, m := range feeds {
-				one := map[string]Message{}
-				if t, ok := m.(Tag); ok {
-					one["tag"] = t.Tag
-					one["data"] = t.Msg
-				} else {
-					one["data"] = m
-				}
-				one["to"] = pin
-				expanded = append(expanded, one)
+	}
+	sort.Strings(unreg)
+	for _, k := range unreg {
+		if sub, ok := c.gadgets[k].circuitry.(*Circuit); ok {
+			desc.Gadgets = append(desc.Gadgets,
+				gadgetDef{Name: k, Circuit: sub.describe()})
+		} else {
+			desc.Unregistered = append(desc.Unregistered, k)
+		}
+	}
+	desc.Wires = c.wires
+	pins := []string{}
+	for pin := range c.feeds {
+		pins = append(pins, pin)
+	}
+	sort.Strings(pins)
+	for _, pin := range pins {
+		for _, m := range c.feeds[pin] {
+			if t, ok := m.(Tag); ok {
+				desc.Feeds = append(desc.Feeds, feedDef{Tag: t.Tag, Data: t.Msg, To: pin})
+			} else {
+				desc.Feeds = append(desc.Feeds, feedDef{Data: m, To: pin})
 			}
 		}
-		desc["feeds"] = expanded
 	}
-	if len(c.labels) > 0 {
-		desc["labels"] = c.labels
+	pins = pins[:0]
+	for pin := range c.timed {
+		pins = append(pins, pin)
+	}
+	sort.Strings(pins)
+	for _, pin := range pins {
+		for _, f := range c.timed[pin] {
+			desc.Feeds = append(desc.Feeds, f.describe(pin))
+		}
+	}
+	externals := []string{}
+	for ext := range c.labels {
+		externals = append(externals, ext)
+	}
+	sort.Strings(externals)
+	for _, ext := range externals {
+		desc.Labels = append(desc.Labels, labelDef{ext, c.labels[ext]})
 	}
 	return desc
 }
@@ -0,0 +1,428 @@
+// The flow command loads circuits from setup files, to run, check, or inspect
+// them. Use "flow help" for a list of commands, and "flow <command> -h" for
+// the flags of each command. It exits with status 1 when a command fails, and
+// with status 2 when it is used incorrectly.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"code.google.com/p/go.exp/fsnotify"
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+type command struct {
+	args    string
+	summary string
+	run     func(fs *flag.FlagSet, args []string, out io.Writer) error
+}
+
+var commands = map[string]*command{
+	"run":      {"[flags]", "run a circuit from a setup file", runCmd},
+	"validate": {"[flags] [file ...]", "check setup files for errors", validateCmd},
+	"describe": {"[flags]", "print a circuit in JSON format", describeCmd},
+	"graph":    {"[flags]", "print a circuit as DOT or Mermaid graph", graphCmd},
+	"registry": {"[flags] list | show type ...", "list the gadget types, or show their pins", registryCmd},
+	"fmt":      {"[flags] file ...", "normalize the layout of JSON setup files", fmtCmd},
+	"shell":    {"[flags]", "build and run a circuit interactively", shellCmd},
+}
+
+// Returned by a command when it was called incorrectly, or when its flags
+// could not be parsed, in which case the flag package has already said so.
+var (
+	errUsage = errors.New("usage error")
+	errFlags = errors.New("invalid flags")
+)
+
+func main() {
+	flag.Usage = func() { usage(os.Stderr) }
+	flag.Parse() // only the glog flags, which come before the command
+	os.Exit(execute(flag.Args(), os.Stdout, os.Stderr))
+}
+
+// Run one command, and return the exit status.
+func execute(args []string, out, errOut io.Writer) int {
+	if len(args) == 0 {
+		usage(errOut)
+		return 2
+	}
+	if args[0] == "help" {
+		usage(out)
+		return 0
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(errOut, "flow: unknown command %q\n", args[0])
+		usage(errOut)
+		return 2
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	fs.Usage = func() {
+		fmt.Fprintf(errOut, "Usage: flow %s %s\n\n", args[0], cmd.args)
+		fs.PrintDefaults()
+	}
+	err := cmd.run(fs, args[1:], out)
+	switch {
+	case err == nil:
+		return 0
+	case err == flag.ErrHelp:
+		return 0
+	case err == errUsage:
+		fs.Usage()
+		return 2
+	case err == errFlags:
+		return 2
+	}
+	fmt.Fprintln(errOut, "flow:", err)
+	return 1
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Flow %s\n\nUsage: flow <command> [flags] [args]\n\n", flow.Version)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range []string{"run", "validate", "describe", "graph", "registry", "fmt", "shell"} {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nDocumentation at http://godoc.org/github.com/jcw/flow")
+}
+
+// Flags for commands which work on one circuit from a setup file.
+type setupFlags struct {
+	file, main *string
+}
+
+func addSetupFlags(fs *flag.FlagSet) setupFlags {
+	return setupFlags{
+		fs.String("s", "setup.json", "circuitry setup file"),
+		fs.String("r", "main", "which registered circuit to use"),
+	}
+}
+
+// Load the setup file and create the selected circuit.
+func (sf setupFlags) circuit() (c *flow.Circuit, err error) {
+	if err = flow.AddToRegistry(*sf.file); err != nil {
+		return nil, err
+	}
+	factory, ok := flow.Registry[*sf.main]
+	if !ok {
+		return nil, fmt.Errorf("%s not found in: %s", *sf.main, *sf.file)
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("cannot create %s: %v", *sf.main, e)
+		}
+	}()
+	c, ok = factory().(*flow.Circuit)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a circuit", *sf.main)
+	}
+	return c, nil
+}
+
+func parseFlags(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return err
+	} else if err != nil {
+		return errFlags
+	}
+	if nargs >= 0 && fs.NArg() != nargs {
+		return errUsage
+	}
+	return nil
+}
+
+func runCmd(fs *flag.FlagSet, args []string, out io.Writer) error {
+	setup := addSetupFlags(fs)
+	watch := fs.Bool("w", false, "reload the circuit when the setup file changes")
+	admin := fs.String("admin", "", "serve the admin API on this address")
+	grace := fs.Duration("grace", 5*time.Second, "how long to let the wires drain on exit")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := setup.circuit()
+	if err != nil {
+		return err
+	}
+	glog.Infof("Flow %s - starting, registry size %d",
+		flow.Version, len(flow.Registry))
+
+	if *watch {
+		go watchSetup(c, *setup.file, *setup.main)
+	}
+	if *admin != "" {
+		go func() {
+			glog.Fatal(http.ListenAndServe(*admin, c.AdminHandler()))
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		c.Run()
+		close(finished)
+	}()
+
+	// on the first signal, let the wires drain and abort the circuit, but
+	// don't wait for gadgets which ignore the abort, or for a second signal
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case <-finished:
+		glog.Infof("Flow %s - normal exit", flow.Version)
+		return nil
+	case sig := <-signals:
+		glog.Infoln("shutting down on", sig)
+	}
+	drained := make(chan bool, 1)
+	go func() { drained <- c.Shutdown(*grace) }()
+	select {
+	case ok := <-drained:
+		select {
+		case <-finished:
+		case <-time.After(*grace):
+			glog.Warningln("some gadgets are still running, exiting anyway")
+		case sig := <-signals:
+			return fmt.Errorf("stopped on %v", sig)
+		}
+		if !ok {
+			return fmt.Errorf("wires not drained within %v", *grace)
+		}
+		return nil
+	case sig := <-signals:
+		return fmt.Errorf("stopped on %v", sig)
+	}
+}
+
+// Watch the setup file and apply all changes to the running circuit.
+func watchSetup(c *flow.Circuit, setupFile, appMain string) {
+	watcher, err := fsnotify.NewWatcher()
+	flow.Check(err)
+	flow.Check(watcher.Watch(setupFile))
+	for range watcher.Event {
+		if err := reloadSetup(c, setupFile, appMain); err != nil {
+			glog.Errorln("cannot reload:", err)
+		}
+	}
+}
+
+// Load the setup file again, with its imports, and apply it to the circuit.
+func reloadSetup(c *flow.Circuit, setupFile, appMain string) error {
+	if err := flow.AddToRegistry(setupFile); err != nil {
+		return err
+	}
+	_, err := c.ReloadRegistered(appMain)
+	return err
+}
+
+func validateCmd(fs *flag.FlagSet, args []string, out io.Writer) error {
+	if err := parseFlags(fs, args, -1); err != nil {
+		return err
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"setup.json"}
+	}
+	failed := 0
+	for _, file := range files {
+		if err := flow.ValidateFile(file); err != nil {
+			fmt.Fprintln(out, err)
+			failed++
+		} else {
+			fmt.Fprintln(out, file+": ok")
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files have errors", failed, len(files))
+	}
+	return nil
+}
+
+func describeCmd(fs *flag.FlagSet, args []string, out io.Writer) error {
+	setup := addSetupFlags(fs)
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	c, err := setup.circuit()
+	if err != nil {
+		return err
+	}
+	return writeJSON(out, c.Describe())
+}
+
+func graphCmd(fs *flag.FlagSet, args []string, out io.Writer) error {
+	setup := addSetupFlags(fs)
+	format := fs.String("f", "dot", "graph format: dot or mermaid")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *format != "dot" && *format != "mermaid" {
+		return fmt.Errorf("unknown graph format: %s", *format)
+	}
+	c, err := setup.circuit()
+	if err != nil {
+		return err
+	}
+	if *format == "mermaid" {
+		return c.WriteMermaid(out)
+	}
+	return c.WriteDot(out)
+}
+
+func registryCmd(fs *flag.FlagSet, args []string, out io.Writer) error {
+	setupFile := fs.String("s", "", "also add the circuits from this setup file")
+	asJSON := fs.Bool("json", false, "print the results in JSON format")
+	if err := parseFlags(fs, args, -1); err != nil {
+		return err
+	}
+	if *setupFile != "" {
+		if err := flow.AddToRegistry(*setupFile); err != nil {
+			return err
+		}
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+	var types []string
+	switch fs.Arg(0) {
+	case "list":
+		if fs.NArg() != 1 {
+			return errUsage
+		}
+		types = flow.Types()
+	case "show":
+		if fs.NArg() < 2 {
+			return errUsage
+		}
+		types = fs.Args()[1:]
+	default:
+		return errUsage
+	}
+
+	pins := map[string][]flow.PinInfo{}
+	for _, typ := range types {
+		p, err := flow.Pins(typ)
+		if err != nil {
+			return err
+		}
+		pins[typ] = p
+	}
+	if *asJSON {
+		return writeJSON(out, pins)
+	}
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, typ := range types {
+		if fs.Arg(0) == "list" {
+			names := []string{}
+			for _, p := range pins[typ] {
+				names = append(names, p.Name)
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", typ, strings.Join(names, " "))
+			continue
+		}
+		fmt.Fprintln(tw, typ+":")
+		for _, p := range pins[typ] {
+			dir := p.Dir
+			if dir == "" {
+				dir = "?"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\n", p.Name, dir)
+		}
+	}
+	return tw.Flush()
+}
+
+func fmtCmd(fs *flag.FlagSet, args []string, out io.Writer) error {
+	write := fs.Bool("w", false, "write the result back to each file")
+	list := fs.Bool("l", false, "only list the files whose layout differs")
+	if err := parseFlags(fs, args, -1); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+	failed := 0
+	for _, file := range fs.Args() {
+		if err := formatFile(file, *write, *list, out); err != nil {
+			fmt.Fprintln(out, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be formatted", failed, fs.NArg())
+	}
+	return nil
+}
+
+// Normalize one setup file, i.e. sort the keys, indent by two spaces, and
+// keep numbers exactly as they were written.
+func formatFile(file string, write, list bool, out io.Writer) error {
+	if ext := strings.ToLower(filepath.Ext(file)); ext != ".json" {
+		return fmt.Errorf("%s: only JSON files can be formatted", file)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	formatted, err := formatJSON(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	switch {
+	case list:
+		if !bytes.Equal(data, formatted) {
+			fmt.Fprintln(out, file)
+		}
+	case write:
+		if !bytes.Equal(data, formatted) {
+			return ioutil.WriteFile(file, formatted, 0666)
+		}
+	default:
+		_, err = out.Write(formatted)
+	}
+	return err
+}
+
+func formatJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after the end")
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return nil, errors.New("not a setup file, expected an object")
+	}
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
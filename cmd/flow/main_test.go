@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jcw/flow"
+)
+
+func Example() {
+	g := flow.NewCircuit()
+	g.Add("clock", "Clock")
+	g.Add("counter", "Counter") // will return 0 when not hooked up
+	g.Add("pipe", "Pipe")
+	g.Add("printer", "Printer")
+	g.Add("repeater", "Repeater")
+	g.Add("sink", "Sink")
+	g.Add("timer", "Timer")
+	g.Run()
+	// Output:
+	// Lost int: 0
+}
+
+func flowCmd(args ...string) (int, string) {
+	var out bytes.Buffer
+	status := execute(args, &out, &out)
+	return status, out.String()
+}
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	flow.Check(err)
+	defer os.RemoveAll(dir)
+	defer flow.RemoveFromRegistry("main") // so that other files can define it
+	good := filepath.Join(dir, "good.json")
+	flow.Check(ioutil.WriteFile(good, []byte(`{"main":{"gadgets":[
+		{"name":"r","type":"Repeater"},{"name":"c","type":"Counter"}],
+		"wires":[{"from":"r.Out","to":"c.In","capacity":0}],
+		"labels":[{"external":"In","internal":"r.In"},
+		{"external":"Out","internal":"c.Out"}]}}`), 0666))
+	bad := filepath.Join(dir, "bad.json")
+	flow.Check(ioutil.WriteFile(bad, []byte(`{"main":{"gadgets":[
+		{"name":"r","type":"NoSuchType"}]}}`), 0666))
+	typo := filepath.Join(dir, "typo.json")
+	flow.Check(ioutil.WriteFile(typo, []byte(`{"main":{"wirse":[]}}`), 0666))
+
+	tests := []struct {
+		args   []string
+		status int
+		output string
+	}{
+		{[]string{"validate", good}, 0, "good.json: ok"},
+		{[]string{"validate", good, bad}, 1, `unknown value: "NoSuchType"`},
+		{[]string{"validate", typo}, 1, "main.wirse: unknown field"},
+		{[]string{"describe", "-s", good}, 0, `"type": "Repeater"`},
+		{[]string{"describe", "-s", good, "-r", "nope"}, 1, "nope not found"},
+		{[]string{"graph", "-s", good, "-f", "mermaid"}, 0, "flowchart"},
+		{[]string{"graph", "-s", good, "-f", "svg"}, 1, "unknown graph format"},
+		{[]string{"registry", "show", "Repeater"}, 0, "Num  in"},
+		{[]string{"registry", "-s", good, "show", "main"}, 0, "Out  out"},
+		{[]string{"registry", "list"}, 0, "Counter"},
+		{[]string{"registry", "show", "NoSuchType"}, 1, "unknown gadget type"},
+		{[]string{"registry"}, 2, "Usage: flow registry"},
+		{[]string{"fmt", "-l", good}, 0, "good.json"},
+		{[]string{"fmt", bad}, 0, `"type": "NoSuchType"`},
+		{[]string{"nope"}, 2, "unknown command"},
+	}
+	for _, test := range tests {
+		status, output := flowCmd(test.args...)
+		if status != test.status || !strings.Contains(output, test.output) {
+			t.Errorf("flow %v: status %d, output:\n%s", test.args, status, output)
+		}
+	}
+
+	// after formatting the file in place, its layout no longer differs
+	if status, _ := flowCmd("fmt", "-w", good); status != 0 {
+		t.Errorf("fmt -w: status %d", status)
+	}
+	if status, output := flowCmd("fmt", "-l", good); status != 0 || output != "" {
+		t.Errorf("fmt -l after -w: status %d, output: %q", status, output)
+	}
+}
+
+func TestShell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	flow.Check(err)
+	defer os.RemoveAll(dir)
+	defer flow.RemoveFromRegistry("main")
+	saved := filepath.Join(dir, "saved.json")
+
+	stdin = strings.NewReader(`
+		add r Repeater
+		add c Counter
+		connect r.Out c.In
+		connect r.Out c.In
+		feed r.Num 3
+		feed r.In hello world
+		tap c.In
+		tap c.Out
+		label Count c.Out
+		start
+		wait
+		save ` + saved + `
+		bogus
+	`)
+	defer func() { stdin = os.Stdin }()
+	status, output := flowCmd("shell")
+	if status != 0 {
+		t.Errorf("shell: status %d", status)
+	}
+	for _, s := range []string{
+		"error: already connected: r.Out",
+		"c.In: hello world",
+		"c.Out: 3",
+		"circuit finished",
+		"error: unknown command: bogus",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("missing %q in output:\n%s", s, output)
+		}
+	}
+
+	// the saved circuit can be loaded again, its main replaces the earlier one
+	flow.RemoveFromRegistry("main")
+	flow.Check(flow.AddToRegistry(saved))
+	pins, err := flow.Pins("main")
+	if err != nil || len(pins) != 1 || pins[0].Name != "Count" {
+		t.Errorf("unexpected pins in saved circuit: %v %v", pins, err)
+	}
+}
+
+func TestReloadSetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	flow.Check(err)
+	defer os.RemoveAll(dir)
+	defer flow.RemoveFromRegistry("main")
+	setup := filepath.Join(dir, "setup.yaml")
+	flow.Check(ioutil.WriteFile(setup, []byte("import: [ app.yaml ]\n"), 0666))
+	app := filepath.Join(dir, "app.yaml")
+	flow.Check(ioutil.WriteFile(app,
+		[]byte("main:\n  gadgets:\n    - { name: a, type: Pipe }\n"), 0666))
+	flow.Check(flow.AddToRegistry(setup))
+	c := flow.Registry["main"]().(*flow.Circuit)
+
+	// main comes from the imported file, which is re-read on every reload
+	flow.Check(ioutil.WriteFile(app,
+		[]byte("main:\n  gadgets:\n    - { name: a, type: Pipe }\n    - { name: b, type: Sink }\n"), 0666))
+	if err := reloadSetup(c, setup, "main"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(c.Describe())
+	if !strings.Contains(string(data), `"name":"b"`) {
+		t.Errorf("gadget b not added by reload: %s", data)
+	}
+}
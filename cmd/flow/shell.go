@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jcw/flow"
+)
+
+// Where the shell reads its commands from, replaced in tests.
+var stdin io.Reader = os.Stdin
+
+const shellHelp = `Commands:
+  types                        list the gadget types in the registry
+  pins <type>                  show the pins of a gadget type
+  add <name> <type>            add a gadget
+  connect <from> <to> [cap]    connect an output pin to an input pin
+  feed <pin> <value>           send a message to an input pin, on start or now
+  label <external> <internal>  expose a pin when saved as circuit
+  tap <pin>                    print the messages sent to or from a pin
+  untap <pin>                  stop printing them
+  start                        run the circuit in the background
+  wait                         wait until the circuit has finished
+  abort                        abort the running circuit
+  show                         print the circuit in JSON format
+  save <file> [name]           save the circuit as setup file, "main" by default
+  quit                         leave the shell
+`
+
+// The state of an interactive shell session. The circuit is kept as a list of
+// edits, so that a fresh copy can be created each time it is started.
+type shell struct {
+	mu      sync.Mutex // protects out, which is also used by the taps
+	out     io.Writer
+	edits   []func(*flow.Circuit)
+	gadgets map[string]string // gadget name to type
+	wired   map[string]bool   // pins which have been connected
+	taps    map[string]func() // pin to stop function, nil when not running
+	tapping sync.WaitGroup    // until all tapped messages have been printed
+	running *flow.Circuit
+	done    chan struct{} // closed when the running circuit has finished
+}
+
+func shellCmd(fs *flag.FlagSet, args []string, out io.Writer) error {
+	setupFile := fs.String("s", "", "also add the circuits from this setup file")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *setupFile != "" {
+		if err := flow.AddToRegistry(*setupFile); err != nil {
+			return err
+		}
+	}
+	sh := &shell{
+		out:     out,
+		gadgets: map[string]string{},
+		wired:   map[string]bool{},
+		taps:    map[string]func(){},
+	}
+	sh.printf("Flow %s shell, type \"help\" for a list of commands\n", flow.Version)
+	scanner := bufio.NewScanner(stdin)
+	for sh.printf("flow> "); scanner.Scan(); sh.printf("flow> ") {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			break
+		}
+		if err := sh.execute(fields[0], fields[1:], scanner.Text()); err != nil {
+			sh.printf("error: %v\n", err)
+		}
+	}
+	sh.printf("\n")
+	if sh.isRunning() {
+		sh.stop()
+	}
+	return scanner.Err()
+}
+
+func (sh *shell) printf(format string, args ...interface{}) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	fmt.Fprintf(sh.out, format, args...)
+}
+
+// Run one command of the shell, the line is needed to get at feed values
+// which contain spaces.
+func (sh *shell) execute(cmd string, args []string, line string) error {
+	nargs := map[string]int{"types": 0, "pins": 1, "add": 2, "label": 2,
+		"tap": 1, "untap": 1, "start": 0, "wait": 0, "abort": 0, "show": 0}
+	if n, ok := nargs[cmd]; ok && len(args) != n {
+		return fmt.Errorf("%s takes %d arguments, see help", cmd, n)
+	}
+	switch cmd {
+	case "help":
+		sh.printf("%s", shellHelp)
+	case "types":
+		sh.printf("%s\n", strings.Join(flow.Types(), " "))
+	case "pins":
+		pins, err := flow.Pins(args[0])
+		if err != nil {
+			return err
+		}
+		for _, p := range pins {
+			sh.printf("  %-10s %s\n", p.Name, p.Dir)
+		}
+	case "add":
+		return sh.add(args[0], args[1])
+	case "connect":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("connect takes 2 or 3 arguments, see help")
+		}
+		capacity := 0
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid capacity: %s", args[2])
+			}
+			capacity = n
+		}
+		return sh.connect(args[0], args[1], capacity)
+	case "feed":
+		if len(args) < 2 {
+			return errors.New("feed takes a pin and a value, see help")
+		}
+		value := strings.TrimSpace(line)
+		value = strings.TrimSpace(value[len(cmd):])
+		value = strings.TrimSpace(value[len(args[0]):])
+		return sh.feed(args[0], parseValue(value))
+	case "label":
+		if strings.Contains(args[0], ".") {
+			return fmt.Errorf("external pin should not include a dot: %s", args[0])
+		}
+		if _, err := sh.pinDir(args[1]); err != nil {
+			return err
+		}
+		sh.edits = append(sh.edits, func(c *flow.Circuit) {
+			c.Label(args[0], args[1])
+		})
+	case "tap":
+		return sh.tap(args[0])
+	case "untap":
+		stop, ok := sh.taps[args[0]]
+		if !ok {
+			return fmt.Errorf("not tapped: %s", args[0])
+		}
+		if stop != nil {
+			stop()
+		}
+		delete(sh.taps, args[0])
+	case "start":
+		return sh.start()
+	case "wait":
+		if !sh.isRunning() {
+			return errors.New("not running")
+		}
+		<-sh.done
+		sh.isRunning() // cleans up
+	case "abort":
+		if !sh.isRunning() {
+			return errors.New("not running")
+		}
+		sh.stop()
+	case "show":
+		c := sh.build()
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+		return writeJSON(sh.out, c.Describe())
+	case "save":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("save takes 1 or 2 arguments, see help")
+		}
+		name := "main"
+		if len(args) == 2 {
+			name = args[1]
+		}
+		return sh.save(args[0], name)
+	default:
+		return fmt.Errorf("unknown command: %s", cmd)
+	}
+	return nil
+}
+
+func (sh *shell) add(name, typ string) error {
+	if strings.Contains(name, ".") {
+		return fmt.Errorf("gadget name should not include a dot: %s", name)
+	}
+	if _, ok := sh.gadgets[name]; ok {
+		return fmt.Errorf("gadget already exists: %s", name)
+	}
+	if _, err := flow.Pins(typ); err != nil {
+		return err
+	}
+	sh.gadgets[name] = typ
+	sh.edits = append(sh.edits, func(c *flow.Circuit) {
+		c.Add(name, typ)
+	})
+	return nil
+}
+
+// Return the direction of a pin, which must exist.
+func (sh *shell) pinDir(pin string) (string, error) {
+	parts := strings.SplitN(pin, ".", 2)
+	typ, ok := sh.gadgets[parts[0]]
+	if len(parts) != 2 || !ok {
+		return "", fmt.Errorf("gadget not found for: %s", pin)
+	}
+	pins, err := flow.Pins(typ)
+	if err != nil {
+		return "", err
+	}
+	name := strings.SplitN(parts[1], ":", 2)[0]
+	for _, p := range pins {
+		if p.Name == name {
+			return p.Dir, nil
+		}
+	}
+	return "", fmt.Errorf("unknown pin: %s", pin)
+}
+
+func (sh *shell) connect(from, to string, capacity int) error {
+	if dir, err := sh.pinDir(from); err != nil {
+		return err
+	} else if dir == "in" {
+		return fmt.Errorf("not an output pin: %s", from)
+	}
+	if dir, err := sh.pinDir(to); err != nil {
+		return err
+	} else if dir == "out" {
+		return fmt.Errorf("not an input pin: %s", to)
+	}
+	if sh.wired[from] {
+		return fmt.Errorf("already connected: %s", from)
+	}
+	sh.wired[from] = true
+	sh.wired[to] = true
+	sh.edits = append(sh.edits, func(c *flow.Circuit) {
+		c.Connect(from, to, capacity)
+	})
+	return nil
+}
+
+func (sh *shell) feed(pin string, m flow.Message) error {
+	if dir, err := sh.pinDir(pin); err != nil {
+		return err
+	} else if dir == "out" {
+		return fmt.Errorf("not an input pin: %s", pin)
+	}
+	if sh.isRunning() {
+		return sh.running.Inject(pin, m)
+	}
+	sh.edits = append(sh.edits, func(c *flow.Circuit) {
+		c.Feed(pin, m)
+	})
+	return nil
+}
+
+// Convert the text of a value to a message: an int if possible, else JSON,
+// or else the text itself.
+func parseValue(s string) flow.Message {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	var any interface{}
+	if json.Unmarshal([]byte(s), &any) == nil {
+		return any
+	}
+	return s
+}
+
+func (sh *shell) tap(pin string) error {
+	if _, ok := sh.taps[pin]; ok {
+		return fmt.Errorf("already tapped: %s", pin)
+	}
+	dir, err := sh.pinDir(pin)
+	if err != nil {
+		return err
+	}
+	if dir == "out" && sh.wired[pin] {
+		return fmt.Errorf("output is connected, tap its destination instead: %s", pin)
+	}
+	sh.taps[pin] = nil
+	if sh.isRunning() {
+		if dir == "out" {
+			sh.printf("this tap takes effect on the next start\n")
+		} else if err := sh.startTap(sh.running, pin); err != nil {
+			delete(sh.taps, pin)
+			return err
+		}
+	}
+	return nil
+}
+
+// Print all messages sent to an input pin of the running circuit.
+func (sh *shell) startTap(c *flow.Circuit, pin string) error {
+	messages, stop, err := c.Tap(pin)
+	if err != nil {
+		return err
+	}
+	sh.taps[pin] = stop
+	sh.tapping.Add(1)
+	go func() {
+		defer sh.tapping.Done()
+		for m := range messages {
+			sh.printf("%s: %v\n", pin, m)
+		}
+	}()
+	return nil
+}
+
+// A tapPrinter prints what it receives, for taps on outputs which are not
+// connected to anything.
+type tapPrinter struct {
+	flow.Gadget
+	In flow.Input
+
+	sh  *shell
+	pin string
+}
+
+func (w *tapPrinter) Run() {
+	for m := range w.In {
+		w.sh.printf("%s: %v\n", w.pin, m)
+	}
+}
+
+// Create a fresh circuit from all the edits so far.
+func (sh *shell) build() *flow.Circuit {
+	c := flow.NewCircuit()
+	for _, edit := range sh.edits {
+		edit(c)
+	}
+	return c
+}
+
+func (sh *shell) start() error {
+	if sh.isRunning() {
+		return errors.New("already running")
+	}
+	c := sh.build()
+	pins := []string{}
+	for pin := range sh.taps {
+		pins = append(pins, pin)
+	}
+	sort.Strings(pins)
+	for i, pin := range pins {
+		if dir, _ := sh.pinDir(pin); dir == "out" {
+			name := fmt.Sprintf("<tap%d>", i)
+			c.AddCircuitry(name, &tapPrinter{sh: sh, pin: pin})
+			c.Connect(pin, name+".In", 0)
+		} else if err := sh.startTap(c, pin); err != nil {
+			sh.printf("cannot tap %s: %v\n", pin, err)
+		}
+	}
+	sh.running = c
+	sh.done = make(chan struct{})
+	go func(done chan struct{}) {
+		c.Run()
+		sh.printf("circuit finished\n")
+		close(done)
+	}(sh.done)
+	return nil
+}
+
+// Return true if the circuit is still running, else clean up after it.
+func (sh *shell) isRunning() bool {
+	if sh.running == nil {
+		return false
+	}
+	select {
+	case <-sh.done:
+		sh.stop()
+		return false
+	default:
+		return true
+	}
+}
+
+// Abort the running circuit, and forget about it, even though some gadgets
+// may not stop right away.
+func (sh *shell) stop() {
+	sh.running.Abort()
+	sh.running = nil
+	for pin, stop := range sh.taps {
+		if stop != nil {
+			stop()
+		}
+		sh.taps[pin] = nil
+	}
+	sh.tapping.Wait()
+}
+
+func (sh *shell) save(file, name string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = writeJSON(f, map[string]interface{}{name: sh.build().Describe()})
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
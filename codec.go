@@ -0,0 +1,342 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// A Codec converts messages to bytes and back, so that they can be sent to
+// another process or stored. Codecs are looked up by name in Codecs.
+type Codec interface {
+	Encode(m Message) ([]byte, error)
+	Decode(data []byte) (Message, error)
+}
+
+// Codecs maps names to the available message codecs. All of them preserve
+// Tag, PacketMap, time.Time, time.Duration, integer types, and []byte, as well
+// as all types registered with RegisterType.
+var Codecs = map[string]Codec{
+	"json": &envelopeCodec{jsonMarshal, jsonUnmarshal},
+	"gob":  &envelopeCodec{gobMarshal, gobUnmarshal},
+	"cbor": &envelopeCodec{cbor.Marshal, cborUnmarshal},
+}
+
+var (
+	typeMutex   sync.RWMutex
+	typeNames   = map[reflect.Type]string{}
+	typesByName = map[string]reflect.Type{}
+)
+
+// RegisterType makes an application type known to all codecs, so that values
+// of that type can be decoded again. The name must be the same in all
+// processes which exchange these values, the example only supplies the type.
+// Values are encoded as JSON, so exported fields are preserved.
+func RegisterType(name string, example interface{}) {
+	typeMutex.Lock()
+	defer typeMutex.Unlock()
+	t := reflect.TypeOf(example)
+	typeNames[t] = name
+	typesByName[name] = t
+}
+
+func init() {
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// An envelopeCodec first converts a message to plain maps, lists, strings,
+// floats, and booleans. Other types are stored as a map with a "$type" entry.
+type envelopeCodec struct {
+	marshal   func(interface{}) ([]byte, error)
+	unmarshal func([]byte) (interface{}, error)
+}
+
+func (c *envelopeCodec) Encode(m Message) ([]byte, error) {
+	v, err := toEnvelope(m)
+	if err != nil {
+		return nil, err
+	}
+	return c.marshal(v)
+}
+
+func (c *envelopeCodec) Decode(data []byte) (Message, error) {
+	v, err := c.unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return fromEnvelope(v)
+}
+
+func typed(name string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"$type": name, "value": value}
+}
+
+func toEnvelope(m Message) (interface{}, error) {
+	switch v := m.(type) {
+	case nil:
+		return map[string]interface{}{"$type": "nil"}, nil
+	case bool, string, float64:
+		return v, nil
+	case float32:
+		return typed("float32", float64(v)), nil
+	case int, int8, int16, int32, int64:
+		return typed(reflect.TypeOf(v).Name(), reflect.ValueOf(v).Int()), nil
+	case uint, uint8, uint16, uint32, uint64:
+		return typed(reflect.TypeOf(v).Name(), reflect.ValueOf(v).Uint()), nil
+	case []byte:
+		return typed("bytes", v), nil
+	case time.Time:
+		return typed("time.Time", v.Format(time.RFC3339Nano)), nil
+	case time.Duration:
+		return typed("time.Duration", int64(v)), nil
+	case Tag:
+		msg, err := toEnvelope(v.Msg)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"$type": "flow.Tag", "tag": v.Tag, "msg": msg}, nil
+	case PacketMap:
+		value, err := mapToEnvelope(v)
+		if err != nil {
+			return nil, err
+		}
+		return typed("flow.PacketMap", value), nil
+	case map[string]interface{}:
+		value, err := mapToEnvelope(v)
+		if _, ok := v["$type"]; ok && err == nil {
+			return typed("map", value), nil // avoid confusion with a typed value
+		}
+		return value, err
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if list[i], err = toEnvelope(e); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	typeMutex.RLock()
+	name, ok := typeNames[reflect.TypeOf(m)]
+	typeMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("cannot encode unregistered type %T", m)
+	}
+	data, err := json.Marshal(m)
+	return typed(name, string(data)), err
+}
+
+func mapToEnvelope(m map[string]interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	for k, e := range m {
+		var err error
+		if out[k], err = toEnvelope(e); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func fromEnvelope(v interface{}) (Message, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.Float64()
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if list[i], err = fromEnvelope(e); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case map[string]interface{}:
+		name, ok := v["$type"].(string)
+		if !ok {
+			return mapFromEnvelope(v)
+		}
+		return typedFromEnvelope(name, v)
+	}
+	return v, nil
+}
+
+func mapFromEnvelope(m map[string]interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	for k, e := range m {
+		var err error
+		if out[k], err = fromEnvelope(e); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func typedFromEnvelope(name string, v map[string]interface{}) (Message, error) {
+	value := v["value"]
+	switch name {
+	case "nil":
+		return nil, nil
+	case "float32":
+		f, err := toFloat(value)
+		return float32(f), err
+	case "int", "int8", "int16", "int32", "int64",
+		"uint", "uint8", "uint16", "uint32", "uint64":
+		return toInteger(name, value)
+	case "bytes":
+		if s, ok := value.(string); ok { // JSON uses base64
+			return base64.StdEncoding.DecodeString(s)
+		}
+		b, _ := value.([]byte)
+		return b, nil
+	case "time.Time":
+		s, _ := value.(string)
+		return time.Parse(time.RFC3339Nano, s)
+	case "time.Duration":
+		n, err := toInteger("int64", value)
+		if err != nil {
+			return nil, err
+		}
+		return time.Duration(n.(int64)), nil
+	case "flow.Tag":
+		tag, _ := v["tag"].(string)
+		msg, err := fromEnvelope(v["msg"])
+		return Tag{tag, msg}, err
+	case "flow.PacketMap", "map":
+		m, _ := value.(map[string]interface{})
+		out, err := mapFromEnvelope(m)
+		if name == "map" {
+			return out, err
+		}
+		return PacketMap(out), err
+	}
+	typeMutex.RLock()
+	t, ok := typesByName[name]
+	typeMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("cannot decode unregistered type %s", name)
+	}
+	s, _ := value.(string)
+	if t.Kind() == reflect.Ptr {
+		p := reflect.New(t.Elem())
+		err := json.Unmarshal([]byte(s), p.Interface())
+		return p.Interface(), err
+	}
+	p := reflect.New(t)
+	err := json.Unmarshal([]byte(s), p.Interface())
+	return p.Elem().Interface(), err
+}
+
+// Convert a decoded number to float64, whatever type the codec produced.
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Float64()
+	case float64:
+		return n, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	}
+	return 0, fmt.Errorf("not a number: %v", v)
+}
+
+// Convert a decoded number to the named integer type.
+func toInteger(name string, v interface{}) (Message, error) {
+	var i int64
+	var u uint64
+	switch n := v.(type) {
+	case json.Number:
+		var err error
+		if i, err = strconv.ParseInt(string(n), 10, 64); err != nil {
+			if u, err = strconv.ParseUint(string(n), 10, 64); err != nil {
+				return nil, err
+			}
+			i = int64(u)
+		}
+		u = uint64(i)
+		if n[0] != '-' && i < 0 {
+			u, _ = strconv.ParseUint(string(n), 10, 64)
+		}
+	default:
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i = rv.Int()
+			u = uint64(i)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			u = rv.Uint()
+			i = int64(u)
+		default:
+			return nil, fmt.Errorf("not an integer: %v", v)
+		}
+	}
+	switch name {
+	case "int":
+		return int(i), nil
+	case "int8":
+		return int8(i), nil
+	case "int16":
+		return int16(i), nil
+	case "int32":
+		return int32(i), nil
+	case "int64":
+		return i, nil
+	case "uint":
+		return uint(u), nil
+	case "uint8":
+		return uint8(u), nil
+	case "uint16":
+		return uint16(u), nil
+	case "uint32":
+		return uint32(u), nil
+	}
+	return u, nil
+}
+
+func jsonMarshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func jsonUnmarshal(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // keeps large integers exact
+	var v interface{}
+	err := dec.Decode(&v)
+	return v, err
+}
+
+func gobMarshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&v)
+	return buf.Bytes(), err
+}
+
+func gobUnmarshal(data []byte) (interface{}, error) {
+	var v interface{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+var cborDecoder, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+func cborUnmarshal(data []byte) (interface{}, error) {
+	var v interface{}
+	err := cborDecoder.Unmarshal(data, &v)
+	return v, err
+}
@@ -0,0 +1,93 @@
+package flow_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+)
+
+type codecPoint struct {
+	X, Y int
+}
+
+func init() {
+	flow.RegisterType("test.point", codecPoint{})
+	flow.RegisterType("test.point*", &codecPoint{})
+}
+
+func ExampleRegisterType() {
+	type reading struct {
+		Sensor string
+		Value  int
+	}
+	flow.RegisterType("example.reading", reading{})
+
+	codec := flow.Codecs["json"]
+	data, err := codec.Encode(flow.Tag{"in", reading{"temp", 21}})
+	flow.Check(err)
+	m, err := codec.Decode(data)
+	flow.Check(err)
+	tag := m.(flow.Tag)
+	fmt.Println(tag.Tag, tag.Msg.(reading).Value)
+	// Output:
+	// in 21
+}
+
+func TestCodecs(t *testing.T) {
+	when := time.Date(2014, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	messages := []flow.Message{
+		nil,
+		true,
+		"abc",
+		1.5,
+		float32(2.5),
+		123,
+		int8(-8),
+		int64(-1 << 62),
+		uint8(200),
+		uint64(1<<64 - 1),
+		[]byte{1, 2, 3},
+		when,
+		3 * time.Second,
+		flow.Tag{"a", 1},
+		flow.Tag{"b", flow.Tag{"c", nil}},
+		flow.PacketMap{"x": 1, "y": "z"},
+		map[string]interface{}{"n": 1.0, "m": []interface{}{"a", 2.0}},
+		map[string]interface{}{"$type": "int", "value": "foo"},
+		[]interface{}{flow.PacketMap{}, flow.Tag{"t", 1.0}},
+		codecPoint{1, 2},
+		&codecPoint{3, 4},
+	}
+	for name, codec := range flow.Codecs {
+		for _, m := range messages {
+			data, err := codec.Encode(m)
+			if err != nil {
+				t.Errorf("%s: encode %#v: %v", name, m, err)
+				continue
+			}
+			out, err := codec.Decode(data)
+			if err != nil {
+				t.Errorf("%s: decode %#v: %v", name, m, err)
+				continue
+			}
+			if tm, ok := out.(time.Time); ok && tm.Equal(when) {
+				continue // the location may be a different value
+			}
+			if !reflect.DeepEqual(out, m) {
+				t.Errorf("%s: expected %#v, got %#v", name, m, out)
+			}
+		}
+	}
+}
+
+func TestCodecUnregistered(t *testing.T) {
+	type unknown struct{}
+	for name, codec := range flow.Codecs {
+		if _, err := codec.Encode(unknown{}); err == nil {
+			t.Errorf("%s: expected an error for an unregistered type", name)
+		}
+	}
+}
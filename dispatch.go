@@ -1,6 +1,8 @@
 package flow
 
 import (
+	"time"
+
 	"github.com/golang/glog"
 )
 
@@ -13,7 +15,12 @@ func init() {
 		c.Connect("tail.Back", "head.Reply", 1) // must have room for reply
 		c.Label("In", "head.In")
 		c.Label("Prefix", "head.Prefix")
+		c.Label("Timeout", "head.Timeout")
+		c.Label("Policy", "head.Policy")
+		c.Label("MaxIdle", "head.MaxIdle")
+		c.Label("MaxGadgets", "head.MaxGadgets")
 		c.Label("Rej", "head.Rej")
+		c.Label("Evicted", "head.Evicted")
 		c.Label("Out", "tail.Out")
 		return c
 	}
@@ -22,6 +29,19 @@ func init() {
 // A dispatcher sends messages to newly created gadgets, based on dispatch tags.
 // These gadgets must have an In and an Out pin. Their output is merged into
 // a single Out pin, the rest is sent to Rej. Registers as "Dispatcher".
+//
+// Before switching to another gadget, the dispatcher waits until all output of
+// the current one has come through. To avoid waiting forever on a gadget which
+// is stuck, a Timeout can be fed in, e.g. "5s". The Policy then decides what
+// happens if it expires: "skip" (the default) switches anyway, "reject" sends
+// the dispatch tag to Rej and rejects all messages until the next one, and
+// "restart" replaces the stuck gadget with a new instance before switching.
+// In each case, a "<stuck>" tag with the name of the gadget is sent to Rej.
+//
+// Gadgets are kept around after switching away from them, unless MaxIdle is
+// fed in, e.g. "10m", to evict those which have not been used that long, or
+// MaxGadgets, to evict the least recently used ones when there are too many.
+// Each eviction sends an "<evicted>" tag with the name of the gadget to Evicted.
 type Dispatcher Circuit
 
 // The implementation uses a circuit with dispatchHead and dispatchTail gadgets.
@@ -30,11 +50,23 @@ type Dispatcher Circuit
 
 type dispatchHead struct {
 	Gadget
-	In     Input
-	Prefix Input
-	Reply  Input
-	Feeds  map[string]Output
-	Rej    Output
+	In         Input
+	Prefix     Input
+	Timeout    Input
+	Policy     Input
+	MaxIdle    Input
+	MaxGadgets Input
+	Reply      Input
+	Feeds      map[string]Output
+	Rej        Output
+	Evicted    Output
+}
+
+// A marker is sent through the current gadget before switching, and is
+// numbered so that a late one from an earlier switch can be recognised.
+type dispatchMarker struct {
+	owner *Circuit
+	seq   int
 }
 
 func (g *dispatchHead) Run() {
@@ -42,32 +74,81 @@ func (g *dispatchHead) Run() {
 	if p, ok := <-g.Prefix; ok {
 		prefix = p.(string)
 	}
+	var timeout time.Duration
+	if m, ok := <-g.Timeout; ok {
+		timeout = dispatchDuration(m, "Timeout")
+	}
+	policy := "skip"
+	if m, ok := <-g.Policy; ok {
+		switch m {
+		case "skip", "reject", "restart":
+			policy = m.(string)
+		default:
+			glog.Warningln("unknown dispatch policy, using skip:", m)
+		}
+	}
+	limits := readLimits(g.MaxIdle, g.MaxGadgets)
+	tick, stop := limits.ticker()
+	defer stop()
 	gadget := ""
-	for m := range g.In {
+	rejecting := false // set after a switch was rejected by the policy
+	seq := 0
+	for {
+		var m Message
+		select {
+		case msg, ok := <-g.In:
+			if !ok {
+				return
+			}
+			m = msg
+		case <-tick:
+			g.evict(limits.victims(gadget, false))
+			continue
+		}
+
 		if tag, ok := m.(Tag); ok && tag.Tag == "<dispatch>" {
-			if tag.Msg == gadget {
+			if tag.Msg == gadget && !rejecting {
 				continue
 			}
 
 			// send (unique!) marker and act on it once it comes back on Reply
-			g.Feeds[gadget].Send(Tag{"<marker>", g.owner})
-			<-g.Reply // TODO: add a timeout?
+			seq++
+			if !rejecting && !g.drain(gadget, seq, timeout) {
+				glog.Errorf("dispatched gadget %s did not drain within %v, policy: %s",
+					prefix+gadget, timeout, policy)
+				g.Rej.Send(Tag{"<stuck>", gadget})
+				switch {
+				case policy == "reject":
+					g.Rej.Send(tag)
+					rejecting = true
+					continue
+				case policy == "restart" && gadget != "":
+					g.restart(gadget, prefix+gadget)
+				}
+			}
+			rejecting = false
 
 			// perform the switch, now that previous output has drained
+			limits.touch(gadget)
 			gadget = tag.Msg.(string)
-			if g.Feeds[gadget] == nil {
-				if Registry[prefix+gadget] == nil {
-					glog.Warningln("cannot dispatch:", prefix+gadget)
-					g.Rej.Send(tag) // report that no such gadget was found
-					gadget = ""
-				} else { // create, hook up, and launch the new gadget
-					glog.Infoln("dispatching to:", prefix+gadget)
-					c := g.owner
-					c.Add(gadget, prefix+gadget)
-					c.Connect("head.Feeds:"+gadget, gadget+".In", 0)
-					c.Connect(gadget+".Out", "tail.In", 0)
-					c.gadgets[gadget].launch()
-				}
+			switch {
+			case g.Feeds[gadget] != nil:
+				limits.touch(gadget)
+			case Registry[prefix+gadget] == nil:
+				glog.Warningln("cannot dispatch:", prefix+gadget)
+				g.Rej.Send(tag) // report that no such gadget was found
+				gadget = ""
+			default: // create, hook up, and launch the new gadget
+				glog.Infoln("dispatching to:", prefix+gadget)
+				g.evict(limits.victims("", true))
+				limits.touch(gadget)
+				c := g.owner
+				c.mu.Lock()
+				c.Add(gadget, prefix+gadget)
+				c.Connect("head.Feeds:"+gadget, gadget+".In", 0)
+				c.Connect(gadget+".Out", "tail.In", 0)
+				c.gadgets[gadget].launch()
+				c.mu.Unlock()
 			}
 
 			// pass through a "consumed" dispatch tag
@@ -76,13 +157,82 @@ func (g *dispatchHead) Run() {
 		}
 
 		feed := g.Feeds[gadget]
-		if feed == nil {
+		if feed == nil || rejecting {
 			feed = g.Rej
 		}
 		feed.Send(m)
 	}
 }
 
+// Convert the message fed to a duration pin, such as Timeout.
+func dispatchDuration(m Message, pin string) time.Duration {
+	switch v := m.(type) {
+	case time.Duration:
+		return v
+	case string:
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	glog.Warningf("invalid %s, ignored: %v", pin, m)
+	return 0
+}
+
+// Evict dispatched gadgets, which have already been drained.
+func (g *dispatchHead) evict(names []string) {
+	for _, name := range names {
+		g.evictDispatched(g.Feeds, name, name)
+		g.Evicted.Send(Tag{"<evicted>", name})
+	}
+}
+
+// Send a marker through a gadget, and wait for it to come back, ignoring any
+// late ones. Returns false if it did not arrive within the timeout, if set.
+func (g *dispatchHead) drain(gadget string, seq int, timeout time.Duration) bool {
+	marker := Tag{"<marker>", dispatchMarker{g.owner, seq}}
+	if timeout <= 0 {
+		g.Feeds[gadget].Send(marker)
+	} else {
+		go g.Feeds[gadget].Send(marker) // this could get stuck as well
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case m, ok := <-g.Reply:
+			if !ok {
+				return false
+			}
+			if m.(Tag).Msg.(dispatchMarker).seq == seq {
+				return true
+			}
+		case <-expired:
+			return false
+		}
+	}
+}
+
+// Replace a stuck gadget by a new instance. The old one is removed, so that the
+// circuit no longer waits for it, and its input is closed, so that it ends once
+// it gets unstuck.
+func (g *dispatchHead) restart(name, typ string) {
+	glog.Warningln("restarting dispatched gadget:", typ)
+	c := g.owner
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gadgets[name].remove()
+	delete(c.gadgets, name)
+	c.AddCircuitry(name, Registry[typ]())
+	fresh := c.gadgets[name]
+	fresh.setOutput("Out", c.gadgets["tail"].getInput("In", 0))
+	g.Feeds[name].(*outlet).moveTo(fresh.getInput("In", 0))
+	fresh.launch()
+}
+
 type dispatchTail struct {
 	Gadget
 	In   Input
@@ -92,10 +242,17 @@ type dispatchTail struct {
 
 func (g *dispatchTail) Run() {
 	for m := range g.In {
-		if tag, ok := m.(Tag); ok && tag.Tag == "<marker>" && tag.Msg == g.owner {
-			g.Back.Send(m)
+		if tag, ok := m.(Tag); ok && tag.Tag == "<marker>" && isMarker(tag.Msg, g.owner) {
+			// a late marker sits in Reply until the next drain discards it, so
+			// don't let it hold up all further output in the meantime
+			go g.Back.Send(m)
 		} else {
 			g.Out.Send(m)
 		}
 	}
 }
+
+func isMarker(m Message, owner *Circuit) bool {
+	marker, ok := m.(dispatchMarker)
+	return ok && marker.owner == owner
+}
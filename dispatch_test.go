@@ -1,6 +1,11 @@
 package flow_test
 
 import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
 	"github.com/jcw/flow"
 	_ "github.com/jcw/flow/gadgets"
 )
@@ -22,3 +27,262 @@ func ExampleDispatcher() {
 	// Lost string: jkl
 	// Lost int: 2
 }
+
+// Passes on all messages, but swallows the markers used by the dispatcher.
+type dispatchSwallow struct {
+	flow.Gadget
+	In  flow.Input
+	Out flow.Output
+}
+
+func (g *dispatchSwallow) Run() {
+	for m := range g.In {
+		if tag, ok := m.(flow.Tag); !ok || tag.Tag != "<marker>" {
+			g.Out.Send(m)
+		}
+	}
+}
+
+// Collects all messages, as strings.
+type dispatchCollect struct {
+	flow.Gadget
+	In flow.Input
+
+	got []string
+}
+
+func (g *dispatchCollect) Run() {
+	for m := range g.In {
+		g.got = append(g.got, fmt.Sprint(m))
+	}
+}
+
+// Passes on all messages.
+func dispatchPass() flow.Circuitry {
+	return flow.Transformer(func(m flow.Message) flow.Message { return m })
+}
+
+func TestDispatcherTimeout(t *testing.T) {
+	flow.Registry["Swallow"] = func() flow.Circuitry { return new(dispatchSwallow) }
+	flow.Registry["Pass"] = dispatchPass
+	defer flow.RemoveFromRegistry("Swallow", "Pass")
+	tests := []struct {
+		policy   string
+		out, rej string
+	}{
+		{"skip", "a {<dispatched> Pass} b", "{<stuck> Swallow}"},
+		{"reject", "a",
+			"{<stuck> Swallow} {<dispatch> Pass} b"},
+		{"restart", "a {<dispatched> Pass} b", "{<stuck> Swallow}"},
+	}
+	for _, test := range tests {
+		out, rej := new(dispatchCollect), new(dispatchCollect)
+		g := flow.NewCircuit()
+		g.Add("d", "Dispatcher")
+		g.AddCircuitry("out", out)
+		g.AddCircuitry("rej", rej)
+		g.Connect("d.Out", "out.In", 0)
+		g.Connect("d.Rej", "rej.In", 0)
+		g.Feed("d.Timeout", "20ms")
+		g.Feed("d.Policy", test.policy)
+		g.Feed("d.In", flow.Tag{"<dispatch>", "Swallow"})
+		g.Feed("d.In", "a")
+		g.Feed("d.In", flow.Tag{"<dispatch>", "Pass"})
+		g.Feed("d.In", "b")
+		g.Run()
+
+		got := strings.Join(out.got, " ")
+		want := "{<dispatched> Swallow} " + test.out
+		if got != want || strings.Join(rej.got, " ") != test.rej {
+			t.Errorf("%s: got out %q, rej %q", test.policy, got, rej.got)
+		}
+	}
+}
+
+func TestDispatcherRestart(t *testing.T) {
+	created := 0
+	flow.Registry["SwallowOnce"] = func() flow.Circuitry {
+		created++
+		if created == 1 {
+			return new(dispatchSwallow) // only the first instance gets stuck
+		}
+		return dispatchPass()
+	}
+	flow.Registry["Pass"] = dispatchPass
+	defer flow.RemoveFromRegistry("SwallowOnce", "Pass")
+	out, rej := new(dispatchCollect), new(dispatchCollect)
+	g := flow.NewCircuit()
+	g.Add("d", "Dispatcher")
+	g.AddCircuitry("out", out)
+	g.AddCircuitry("rej", rej)
+	g.Connect("d.Out", "out.In", 0)
+	g.Connect("d.Rej", "rej.In", 0)
+	g.Feed("d.Timeout", "20ms")
+	g.Feed("d.Policy", "restart")
+	for _, key := range []string{"SwallowOnce", "Pass", "SwallowOnce", "Pass"} {
+		g.Feed("d.In", flow.Tag{"<dispatch>", key})
+		g.Feed("d.In", "to "+key)
+	}
+	g.Run()
+
+	want := "{<dispatched> SwallowOnce} to SwallowOnce {<dispatched> Pass} to Pass " +
+		"{<dispatched> SwallowOnce} to SwallowOnce {<dispatched> Pass} to Pass"
+	if got := strings.Join(out.got, " "); got != want {
+		t.Errorf("got out %q", got)
+	}
+	if got := strings.Join(rej.got, " "); got != "{<stuck> SwallowOnce}" {
+		t.Errorf("got rej %q", got)
+	}
+}
+
+// Passes on all messages, but hangs forever once it gets a marker.
+type dispatchHang struct {
+	flow.Gadget
+	In  flow.Input
+	Out flow.Output
+}
+
+func (g *dispatchHang) Run() {
+	for m := range g.In {
+		if tag, ok := m.(flow.Tag); ok && tag.Tag == "<marker>" {
+			select {}
+		}
+		g.Out.Send(m)
+	}
+}
+
+func TestDispatcherRestartHung(t *testing.T) {
+	flow.Registry["Hang"] = func() flow.Circuitry { return new(dispatchHang) }
+	flow.Registry["Pass"] = dispatchPass
+	defer flow.RemoveFromRegistry("Hang", "Pass")
+	out := new(dispatchCollect)
+	g := flow.NewCircuit()
+	g.Add("d", "Dispatcher")
+	g.AddCircuitry("out", out)
+	g.Connect("d.Out", "out.In", 0)
+	g.Feed("d.Timeout", "20ms")
+	g.Feed("d.Policy", "restart")
+	for _, key := range []string{"Hang", "Pass"} {
+		g.Feed("d.In", flow.Tag{"<dispatch>", key})
+		g.Feed("d.In", "to "+key)
+	}
+	done := make(chan struct{})
+	go func() {
+		g.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("circuit did not finish after restarting a hung gadget")
+	}
+
+	want := "{<dispatched> Hang} to Hang {<dispatched> Pass} to Pass"
+	if got := strings.Join(out.got, " "); got != want {
+		t.Errorf("got out %q", got)
+	}
+}
+
+// Passes on all messages, but holds up the markers used by the dispatcher.
+type dispatchSlow struct {
+	flow.Gadget
+	In  flow.Input
+	Out flow.Output
+}
+
+func (g *dispatchSlow) Run() {
+	for m := range g.In {
+		if tag, ok := m.(flow.Tag); ok && tag.Tag == "<marker>" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		g.Out.Send(m)
+	}
+}
+
+func TestDispatcherLateMarkers(t *testing.T) {
+	flow.Registry["Slow1"] = func() flow.Circuitry { return new(dispatchSlow) }
+	flow.Registry["Slow2"] = func() flow.Circuitry { return new(dispatchSlow) }
+	flow.Registry["Pass"] = dispatchPass
+	defer flow.RemoveFromRegistry("Slow1", "Slow2", "Pass")
+	out := new(dispatchCollect)
+	g := flow.NewCircuit()
+	g.Add("d", "Dispatcher")
+	g.AddCircuitry("out", out)
+	g.Connect("d.Out", "out.In", 0)
+	g.Feed("d.Timeout", "20ms")
+	for _, key := range []string{"Slow1", "Slow2", "Pass"} {
+		g.Feed("d.In", flow.Tag{"<dispatch>", key})
+		g.Feed("d.In", "to "+key)
+	}
+	done := make(chan struct{})
+	go func() {
+		g.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("late markers held up the dispatcher")
+	}
+
+	want := "{<dispatched> Slow1} to Slow1 {<dispatched> Slow2} to Slow2 " +
+		"{<dispatched> Pass} to Pass"
+	if got := strings.Join(out.got, " "); got != want {
+		t.Errorf("got out %q", got)
+	}
+}
+
+func TestDispatcherEviction(t *testing.T) {
+	for _, name := range []string{"evict-a", "evict-b", "evict-c"} {
+		flow.Registry[name] = dispatchPass
+	}
+	defer flow.RemoveFromRegistry("evict-a", "evict-b", "evict-c")
+	out, evicted := new(dispatchCollect), new(dispatchCollect)
+	g := flow.NewCircuit()
+	g.Add("d", "Dispatcher")
+	g.AddCircuitry("out", out)
+	g.AddCircuitry("evicted", evicted)
+	g.Connect("d.Out", "out.In", 0)
+	g.Connect("d.Evicted", "evicted.In", 0)
+	g.Feed("d.Prefix", "evict-")
+	g.Feed("d.MaxGadgets", 2)
+	for _, key := range []string{"a", "b", "a", "c", "b"} {
+		g.Feed("d.In", flow.Tag{"<dispatch>", key})
+		g.Feed("d.In", key)
+	}
+	g.Run()
+
+	if got := strings.Join(evicted.got, " "); got != "{<evicted> b} {<evicted> a}" {
+		t.Errorf("got evicted %q", got)
+	}
+	if got := strings.Join(out.got, " "); !strings.HasSuffix(got, "{<dispatched> b} b") {
+		t.Errorf("got out %q", got)
+	}
+}
+
+func TestPacketMapDispatcherIdle(t *testing.T) {
+	for _, name := range []string{"evict-a", "evict-b"} {
+		flow.Registry[name] = dispatchPass
+	}
+	defer flow.RemoveFromRegistry("evict-a", "evict-b")
+	out, evicted := new(dispatchCollect), new(dispatchCollect)
+	g := flow.NewCircuit()
+	g.Add("d", "PacketMapDispatcher")
+	g.AddCircuitry("out", out)
+	g.AddCircuitry("evicted", evicted)
+	g.Connect("d.Out", "out.In", 0)
+	g.Connect("d.Evicted", "evicted.In", 0)
+	g.Feed("d.Prefix", "evict-")
+	g.Feed("d.Field", "key")
+	g.Feed("d.MaxIdle", "20ms")
+	g.Feed("d.In", flow.PacketMap{"key": "a"})
+	g.FeedAfter("d.In", flow.PacketMap{"key": "b"}, 100*time.Millisecond)
+	g.Run()
+
+	if got := strings.Join(evicted.got, " "); got != "{<evicted> a}" {
+		t.Errorf("got evicted %q", got)
+	}
+	if len(out.got) != 2 {
+		t.Errorf("got out %q", out.got)
+	}
+}
@@ -55,6 +55,118 @@ from a JSON description:
     g.LoadJSON(data)
     g.Run()
 
+Strings in a definition can contain placeholders such as "${APP_DIR}", which
+are filled in from the values passed to SetParams, from Config, from the
+environment, or from the "params" section of the definition itself. A gadget
+entry can pass its own "params" to a circuit defined in a setup file, so that
+one definition can be used for several differently configured instances.
+
+A setup file can import other files with an "import" list of file names or
+glob patterns, relative to the importing file. Entries such as { "file":
+"local.json", "optional": true } are skipped if the file does not exist. A
+gadget type such as "lib/filters.json#smooth" refers to the "smooth" circuit in
+that file. Defining the same name in two different files is an error, also
+across calls to AddToRegistry, and so is redefining a built-in gadget, unless
+the name is taken out with RemoveFromRegistry first.
+
+The structure of these files is described by the JSON Schema in "schema.json".
+LoadJSONStrict and AddToRegistryStrict validate against it before loading, so
+that unknown fields such as a misspelled "capcity" are reported instead of
+silently being ignored. ValidateFile does the same, but leaves the registry as
+is.
+
+The same structure can also be loaded from YAML or TOML, using LoadYAML and
+LoadTOML. AddToRegistry picks the format based on the file extension. Problems
+in a definition, such as unknown gadget types or pins, are reported with the
+line number of the offending entry. AddToRegistry checks all definitions right
+away, even though circuits are only created when they are used.
+
+Circuits can also be written in the textual notation commonly used for FBP,
+using LoadFBP, and written out again with WriteFBP:
+
+    '3' -> NUM r(Repeater) OUT -> IN c(Counter)
+    OUTPORT=c.OUT:Count
+
+Feeds can also be sent after the circuit has started, after a delay or at a
+given time, and optionally be repeated. The input pin stays open until then.
+In JSON, add "after", "at", or "every" to the feed entry:
+
+    g.FeedScheduled("t.In", "tick", flow.Schedule{Every: time.Second})
+
+Gadgets which need a lot of processing can be run as a pool of instances, which
+receive messages from the same In pin and merge their Out pins into one. With
+ordered set to true, output comes out in the same order as the input:
+
+    g.AddPool("d", "Decoder", 4, true)
+
+In JSON, this is done by adding "replicas" and "ordered" to a gadget entry.
+The gadget type can also be a circuit with In and Out labels. Ordered pools
+send markers through each instance, so the gadget must pass on any tags it does
+not recognise.
+
+Messages on a durable wire are kept in a file until they have been delivered,
+so that they are not lost when the receiver is slow or the process restarts.
+Whatever was pending is delivered on the next Run. In JSON, add a "durable"
+entry with the file name to the wire:
+
+    g.ConnectDurable("r.Out", "db.In", 100, "queues/db")
+
+Bursts of messages, e.g. from a Clock or the network, can be smoothed out with
+a rate limit on a wire. Senders are held up when the limit is reached, or with
+Drop set, messages are discarded. In JSON, add "rate", "burst", and "drop":
+
+    g.ConnectLimited("clock.Out", "db.In", 0, flow.RateLimit{Rate: 10, Burst: 5})
+
+Gadgets which implement Stateful, such as Counter, can keep their state across
+restarts. With checkpoints enabled, their state is saved periodically and when
+Run finishes, and restored when the circuit is run again:
+
+    g.SetCheckpoints("state", time.Minute)
+
+A running circuit can be inspected with Stats, and messages can be sent to it
+with Inject or observed with Tap. AdminHandler makes all this available over
+HTTP, together with the description of the circuit and the registry:
+
+    go http.ListenAndServe(":8080", g.AdminHandler())
+
+The same counters, such as messages per pin, queue depths, send timeouts, lost
+messages, and panics, are available for Prometheus through MetricsHandler.
+To find out which gadgets are slow, call EnableProfiling before Run, and then
+WriteProfile for a report of processing, send, and queue times.
+
+A running circuit can be changed by passing an updated JSON description to
+Reload. Only the differences are applied, unaffected gadgets keep running:
+
+    changes, err := g.Reload(newData)
+
+For setups in other formats, call AddToRegistry again and then ReloadRegistered
+with the name of the circuit.
+
+To get an overview of a circuit, WriteDot and WriteMermaid draw it as Graphviz
+or Mermaid graph, with sub-circuits shown as clusters.
+
+Application settings are kept in Configuration, which combines defaults,
+configuration files, environment variables, and command-line flags, and has
+typed getters such as Int, Bool, and Duration:
+
+    flow.Configuration.AddFile("app.conf")
+    timeout, err := flow.Configuration.Duration("TIMEOUT")
+
+Messages can be sent to other processes or stored with one of the Codecs, i.e.
+"json", "gob", or "cbor". These keep Tag and PacketMap intact, and support the
+application's own message types once they have been registered:
+
+    flow.RegisterType("app.Reading", Reading{})
+
+The "flow" command in cmd/flow works with setup files from the shell, e.g. to
+run, validate, describe, draw, or reformat circuits, and to list the gadget
+types in the registry with their pins, as also returned by Types and Pins:
+
+    flow registry -s setup.json show main
+
+Use "flow shell" to add gadgets, connect and feed them, and watch the messages
+in a running circuit interactively. The result can be saved as setup file.
+
 Te define your own gadget, create a type which embeds Gadget and defines Run():
 
     type LineLengths struct {
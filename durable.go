@@ -0,0 +1,354 @@
+package flow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Connect an output pin with an input pin through a durable wire. All messages
+// are appended to the file at path until they have been delivered, so those
+// which were still pending when the process stopped are delivered on the next
+// Run. Up to capacity messages are also kept in memory, any further ones are
+// read back from disk. Sends on a durable wire never block.
+func (c *Circuit) ConnectDurable(from, to string, capacity int, path string) {
+	c.connect(wireDef{From: from, To: to, Capacity: capacity, Durable: path})
+}
+
+func (c *Circuit) connect(wd wireDef) {
+	c.wires = append(c.wires, wd)
+	w := c.gadgetOf(wd.To).getInput(pinPart(wd.To), wd.Capacity)
+	if wd.Durable != "" {
+		w.makeDurable(wd.Durable)
+	}
+	if limit := wd.rateLimit(); limit != nil {
+		w.limit(limit)
+	}
+	c.gadgetOf(wd.From).setOutput(pinPart(wd.From), w)
+}
+
+// Turn a wire into a durable one, before its receiver has been launched.
+func (c *wire) makeDurable(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.durable == path:
+	case c.durable != "":
+		glog.Fatalf("input has two durable wires: %s and %s", c.durable, path)
+	case c.dest.launched:
+		glog.Warningln("input is already running, not durable:", path)
+	default:
+		c.durable = path
+		c.channel = make(chan Message) // the queue does all the buffering
+	}
+}
+
+// Return the queue of a durable wire, opening it on first use. This can also
+// mark the queue as being delivered, before the wire can be closed.
+func (c *wire) diskQueue(deliver bool) (*diskQueue, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queue == nil || c.queue.released() {
+		q, err := openQueue(c.durable, c.capacity)
+		if err != nil {
+			return nil, err
+		}
+		q.closed = c.closed
+		c.queue = q
+	}
+	if deliver {
+		c.queue.mu.Lock()
+		c.queue.delivering = true
+		c.queue.mu.Unlock()
+	}
+	return c.queue, nil
+}
+
+// Start delivering the messages of a durable wire to its receiving gadget.
+// This is tracked as part of the circuit, so that Run only returns once all
+// messages have been delivered or the receiver has stopped.
+func (g *Gadget) startDelivery(w *wire) {
+	q, err := w.diskQueue(true)
+	if err != nil {
+		glog.Fatalln("durable wire:", err)
+	}
+	g.owner.wait.Add(1)
+	go func() {
+		defer g.owner.wait.Done()
+		q.deliver(w.channel, g.owner.abort, g.done)
+	}()
+}
+
+// All queues which are currently open, to prevent using a file twice.
+var (
+	queueMutex sync.Mutex
+	openQueues = map[string]*diskQueue{}
+)
+
+// A diskQueue keeps the messages of a durable wire in an append-only file. Each
+// message is stored as its length as 4-byte big-endian integer, followed by
+// its "json" encoding. The offset up to which messages have been delivered is
+// kept in a second file, with ".pos" added to its name.
+type diskQueue struct {
+	path  string
+	limit int // maximum number of messages kept in memory
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	log        *os.File
+	pos        *os.File
+	mem        []queued // messages which need not be read back from disk
+	done       int64    // offset up to which messages have been delivered
+	read       int64    // offset up to which messages are in memory or delivered
+	write      int64    // offset at which the next message will be appended
+	closed     bool     // set when no more messages will be added
+	delivering bool     // set while messages are being sent to the receiver
+	stopped    bool     // set when delivery should stop
+}
+
+type queued struct {
+	msg Message
+	end int64 // offset just past this message in the file
+}
+
+func openQueue(path string, limit int) (*diskQueue, error) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	if openQueues[path] != nil {
+		return nil, fmt.Errorf("already in use: %s", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := os.OpenFile(path+".pos", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	q := &diskQueue{path: path, limit: limit, log: log, pos: pos}
+	q.cond = sync.NewCond(&q.mu)
+	if err := q.recover(); err != nil {
+		log.Close()
+		pos.Close()
+		return nil, err
+	}
+	openQueues[path] = q
+	return q, nil
+}
+
+// Find out what remains to be delivered, and drop a partially written message
+// at the end of the file.
+func (q *diskQueue) recover() error {
+	var buf [8]byte
+	if _, err := q.pos.ReadAt(buf[:], 0); err == nil {
+		q.done = int64(binary.BigEndian.Uint64(buf[:]))
+	}
+	info, err := q.log.Stat()
+	if err != nil {
+		return err
+	}
+	if q.done > info.Size() {
+		q.done = info.Size()
+	}
+	end := q.done
+	for end+4 <= info.Size() {
+		var size [4]byte
+		if _, err := q.log.ReadAt(size[:], end); err != nil {
+			return err
+		}
+		next := end + 4 + int64(binary.BigEndian.Uint32(size[:]))
+		if next > info.Size() {
+			break
+		}
+		end = next
+	}
+	if end < info.Size() {
+		glog.Warningf("durable wire %s: dropping %d bytes of an incomplete message",
+			q.path, info.Size()-end)
+		if err := q.log.Truncate(end); err != nil {
+			return err
+		}
+	}
+	q.read, q.write = q.done, end
+	if q.done < q.write {
+		glog.Infof("durable wire %s: %d bytes pending", q.path, q.write-q.done)
+	}
+	return nil
+}
+
+// Append a message, it is also kept in memory if there are no older messages
+// on disk which still need to be read back.
+func (q *diskQueue) put(m Message) error {
+	data, err := Codecs["json"].Encode(m)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.log == nil {
+		return ErrClosedOutput
+	}
+	if _, err := q.log.WriteAt(frame, q.write); err != nil {
+		return err
+	}
+	inMemory := q.read == q.write && len(q.mem) < q.limit
+	q.write += int64(len(frame))
+	if inMemory {
+		q.mem = append(q.mem, queued{m, q.write})
+		q.read = q.write
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// Return the next message to deliver, waiting for one if needed. Returns false
+// once the queue has been closed and drained, or delivery has been stopped.
+func (q *diskQueue) next() (queued, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.stopped {
+		if len(q.mem) > 0 {
+			item := q.mem[0]
+			q.mem = q.mem[1:]
+			return item, true
+		}
+		if q.read < q.write {
+			item, err := q.readAt(q.read)
+			if err != nil {
+				glog.Errorf("durable wire %s: %v", q.path, err)
+				q.stopped = true
+				break
+			}
+			q.read = item.end
+			return item, true
+		}
+		if q.closed {
+			break
+		}
+		q.cond.Wait()
+	}
+	return queued{}, false
+}
+
+func (q *diskQueue) readAt(offset int64) (queued, error) {
+	var size [4]byte
+	if _, err := q.log.ReadAt(size[:], offset); err != nil {
+		return queued{}, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := q.log.ReadAt(data, offset+4); err != nil && err != io.EOF {
+		return queued{}, err
+	}
+	m, err := Codecs["json"].Decode(data)
+	return queued{m, offset + 4 + int64(len(data))}, err
+}
+
+// Record that all messages up to the given offset have been delivered. Once
+// everything has been delivered, the file is emptied again.
+func (q *diskQueue) ack(end int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.done = end
+	if q.done == q.write {
+		if err := q.log.Truncate(0); err != nil {
+			glog.Errorf("durable wire %s: %v", q.path, err)
+			return
+		}
+		q.done, q.read, q.write = 0, 0, 0
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(q.done))
+	if _, err := q.pos.WriteAt(buf[:], 0); err != nil {
+		glog.Errorf("durable wire %s: %v", q.path, err)
+	}
+}
+
+// Send out messages until the queue is drained, or the circuit is aborted, or
+// the receiving gadget is done. Undelivered messages stay on disk.
+func (q *diskQueue) deliver(out chan Message, abort, done <-chan struct{}) {
+	exit := make(chan struct{})
+	defer close(exit)
+	go func() {
+		select {
+		case <-abort:
+		case <-done:
+		case <-exit:
+			return
+		}
+		q.mu.Lock()
+		q.stopped = true
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}()
+
+	defer func() {
+		close(out)
+		q.mu.Lock()
+		q.delivering = false
+		q.mu.Unlock()
+		q.release()
+	}()
+	for {
+		item, ok := q.next()
+		if !ok {
+			return
+		}
+		select {
+		case out <- item.msg:
+			q.ack(item.end)
+		case <-abort:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// Called when no more messages will be added.
+func (q *diskQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.release()
+}
+
+// Close the files once there will be no more sends and no more deliveries.
+// The files are removed if there is nothing left to deliver.
+func (q *diskQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.log == nil || !q.closed || q.delivering {
+		return
+	}
+	q.log.Close()
+	q.pos.Close()
+	q.log, q.pos = nil, nil
+	if q.done == q.write {
+		os.Remove(q.path)
+		os.Remove(q.path + ".pos")
+	}
+	queueMutex.Lock()
+	delete(openQueues, q.path)
+	queueMutex.Unlock()
+}
+
+// Return true if the files have been closed, the queue can then be re-opened.
+func (q *diskQueue) released() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.log == nil
+}
@@ -0,0 +1,146 @@
+package flow_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func ExampleCircuit_ConnectDurable() {
+	dir, err := ioutil.TempDir("", "flow")
+	flow.Check(err)
+	defer os.RemoveAll(dir)
+
+	g := flow.NewCircuit()
+	g.Add("r", "Repeater")
+	g.Add("p", "Printer")
+	g.ConnectDurable("r.Out", "p.In", 1, filepath.Join(dir, "queue"))
+	g.Feed("r.Num", 3)
+	g.Feed("r.In", "abc")
+	g.Run()
+	// Output:
+	// abc
+	// abc
+	// abc
+}
+
+// Sends a fixed list of messages.
+type durableSource struct {
+	flow.Gadget
+	Out flow.Output
+
+	msgs []flow.Message
+}
+
+func (g *durableSource) Run() {
+	for _, m := range g.msgs {
+		g.Out.Send(m)
+	}
+}
+
+// Collects messages, and stops after a given number if it is not zero.
+type durableTake struct {
+	flow.Gadget
+	In flow.Input
+
+	n   int
+	got []flow.Message
+}
+
+func (g *durableTake) Run() {
+	for m := range g.In {
+		g.got = append(g.got, m)
+		if len(g.got) == g.n {
+			return
+		}
+	}
+}
+
+func runDurable(path string, msgs []flow.Message, n int) []flow.Message {
+	take := &durableTake{n: n}
+	g := flow.NewCircuit()
+	g.AddCircuitry("s", &durableSource{msgs: msgs})
+	g.AddCircuitry("t", take)
+	g.ConnectDurable("s.Out", "t.In", 2, path)
+	g.Run()
+	return take.got
+}
+
+func TestDurableRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	flow.Check(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "queue")
+
+	got := runDurable(path, []flow.Message{1, "two", 3.0, flow.Tag{"four", 4}, 5}, 2)
+	if !reflect.DeepEqual(got, []flow.Message{1, "two"}) {
+		t.Errorf("first run, got: %v", got)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("queue file should remain: %v", err)
+	}
+
+	got = runDurable(path, []flow.Message{6}, 0)
+	expect := []flow.Message{3.0, flow.Tag{"four", 4}, 5, 6}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("second run, expected %v, got: %v", expect, got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("queue file should be removed when empty: %v", err)
+	}
+}
+
+func TestDurableIncomplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	flow.Check(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue")
+
+	runDurable(path, []flow.Message{"a", "b"}, 1)
+	// simulate a crash halfway through appending a message
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	flow.Check(err)
+	f.Write([]byte{0, 0, 0, 9, '"'})
+	f.Close()
+
+	got := runDurable(path, []flow.Message{"c"}, 0)
+	if !reflect.DeepEqual(got, []flow.Message{"b", "c"}) {
+		t.Errorf("expected [b c], got: %v", got)
+	}
+}
+
+func TestDurableJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	flow.Check(err)
+	defer os.RemoveAll(dir)
+	flow.Config["QUEUE_DIR"] = dir
+	defer delete(flow.Config, "QUEUE_DIR")
+
+	g := flow.NewCircuit()
+	err = g.LoadJSONStrict([]byte(`{
+		"gadgets": [
+			{ "name": "r", "type": "Repeater" },
+			{ "name": "c", "type": "Counter" }
+		],
+		"wires": [
+			{ "from": "r.Out", "to": "c.In", "durable": "${QUEUE_DIR}/q" }
+		],
+		"feeds": [
+			{ "data": 5, "to": "r.Num" },
+			{ "data": "x", "to": "r.In" }
+		]
+	}`))
+	flow.Check(err)
+	data, err := json.Marshal(g.Describe())
+	flow.Check(err)
+	if !strings.Contains(string(data), `"durable":"`+dir+`/q"`) {
+		t.Errorf("durable path not in description: %s", data)
+	}
+}
@@ -0,0 +1,117 @@
+package flow
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Limits on the gadgets created by a dispatcher, to avoid keeping them around
+// forever: gadgets not used for longer than maxIdle are evicted, and so are the
+// least recently used ones when there would be more than maxGadgets. A zero
+// value means no limit. The last use is only tracked if there is a limit.
+type dispatchLimits struct {
+	maxIdle    time.Duration
+	maxGadgets int
+	lastUsed   map[string]time.Time // dispatch key to time of last use
+}
+
+// Read the limits from the MaxIdle and MaxGadgets pins of a dispatcher.
+func readLimits(maxIdle, maxGadgets Input) *dispatchLimits {
+	l := &dispatchLimits{}
+	if m, ok := <-maxIdle; ok {
+		l.maxIdle = dispatchDuration(m, "MaxIdle")
+	}
+	if m, ok := <-maxGadgets; ok {
+		if n, err := toFloat(m); err == nil && n >= 0 {
+			l.maxGadgets = int(n)
+		} else {
+			glog.Warningln("invalid MaxGadgets, ignored:", m)
+		}
+	}
+	if l.maxIdle > 0 || l.maxGadgets > 0 {
+		l.lastUsed = map[string]time.Time{}
+	}
+	return l
+}
+
+// Return a channel which ticks often enough to evict idle gadgets at most half
+// the idle time late, or nil if there is no idle limit. Call stop when done.
+func (l *dispatchLimits) ticker() (tick <-chan time.Time, stop func()) {
+	if l.maxIdle <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(l.maxIdle / 2)
+	return t.C, t.Stop
+}
+
+// Note that the gadget for a dispatch key has just been used. The empty key is
+// not a gadget, it stands for the wire which keeps the tail alive.
+func (l *dispatchLimits) touch(key string) {
+	if l.lastUsed != nil && key != "" {
+		l.lastUsed[key] = time.Now()
+	}
+}
+
+// Return the keys of the gadgets to evict, and forget about them: all those
+// which have been idle for too long, and then the least recently used ones,
+// until there is room for one more gadget if adding is set. The busy one is
+// never evicted, since it may still be processing messages.
+func (l *dispatchLimits) victims(busy string, adding bool) []string {
+	keys := []string{}
+	for k := range l.lastUsed {
+		if k != busy {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return l.lastUsed[keys[i]].Before(l.lastUsed[keys[j]])
+	})
+	now, live := time.Now(), len(l.lastUsed)
+	if adding {
+		live++
+	}
+	n := 0
+	for _, k := range keys {
+		idle := l.maxIdle > 0 && now.Sub(l.lastUsed[k]) > l.maxIdle
+		full := l.maxGadgets > 0 && live > l.maxGadgets
+		if !idle && !full {
+			break
+		}
+		delete(l.lastUsed, k)
+		live--
+		n++
+	}
+	return keys[:n]
+}
+
+// Remove a gadget created by a dispatcher, given its dispatch key and name.
+// Its feed is retired, so that its input gets closed and the gadget ends once
+// it has processed what it got, which in turn closes its output to the tail.
+func (g *Gadget) evictDispatched(feeds map[string]Output, key, name string) {
+	glog.Infoln("evicting dispatched gadget:", name)
+	c := g.owner
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if o, ok := feeds[key].(*outlet); ok {
+		o.retire()
+	}
+	delete(feeds, key)
+	delete(g.outputs, "Feeds:"+key)
+	delete(c.gadgets, name)
+	wires := []wireDef{}
+	for _, w := range c.wires {
+		if gadgetPart(w.From) != name && gadgetPart(w.To) != name {
+			wires = append(wires, w)
+		}
+	}
+	c.wires = wires
+	defs := []gadgetDef{}
+	for _, d := range c.gnames {
+		if d.Name != name {
+			defs = append(defs, d)
+		}
+	}
+	c.gnames = defs
+}
@@ -0,0 +1,390 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Load a circuit from a description in FBP notation, for example:
+//
+//	# repeat each message three times, then count them
+//	'3' -> NUM r(Repeater) OUT -> IN c(Counter)
+//	INPORT=r.IN:IN
+//	OUTPORT=c.OUT:OUT
+//
+// Port names are matched to pins without regard to case, so "NUM" becomes
+// "Num". Indexed ports such as "OUT[x]" refer to map pins, i.e. "Out:x". An
+// initial packet which looks like an integer is fed as int, if it is valid JSON
+// it is decoded, else it is fed as string. Component metadata can be used to
+// set up a pool, e.g. "d(Decoder:replicas=4,ordered=true)".
+func (c *Circuit) LoadFBP(data []byte) error {
+	return c.loadDefinition(fbpDefinition("", data))
+}
+
+func fbpDefinition(filename string, data []byte) *definition {
+	p := &fbpParser{file: filename, lines: map[string]int{}}
+	err := p.parse(data)
+	return &definition{
+		file: filename,
+		decode: func() (*config, error) {
+			if err != nil {
+				return nil, err
+			}
+			conf := p.conf
+			return &conf, nil
+		},
+		lines: p.lines,
+	}
+}
+
+type fbpParser struct {
+	file  string
+	conf  config
+	lines map[string]int
+	types map[string]string // type of each process
+	ports []string          // exported port of each label, mapped at the end
+	line  int
+}
+
+// The tokens of a statement, with quoted initial packets kept as one token.
+var fbpToken = regexp.MustCompile(`'(\\.|[^'\\])*'|->|[^\s,#'(]+(\([^)]*\))?|,|#.*|'`)
+
+var fbpNode = regexp.MustCompile(`^([A-Za-z_][\w-]*)(\(([\w/-]*)(:([^)]*))?\))?$`)
+var fbpPort = regexp.MustCompile(`^([A-Za-z_]\w*)(\[([\w-]+)\])?$`)
+var fbpExport = regexp.MustCompile(`^(INPORT|OUTPORT)=([\w-]+)\.([\w\[\]-]+):([A-Za-z_]\w*)$`)
+
+func (p *fbpParser) fail(format string, args ...interface{}) error {
+	return &DefinitionError{File: p.file, Line: p.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *fbpParser) parse(data []byte) error {
+	p.types = map[string]string{}
+	for i, text := range strings.Split(string(data), "\n") {
+		p.line = i + 1
+		stmt := []string{}
+		for _, tok := range fbpToken.FindAllString(text, -1) {
+			switch {
+			case strings.HasPrefix(tok, "#"):
+				// comment, ignore the rest of the line
+			case tok == ",":
+				if err := p.statement(stmt); err != nil {
+					return err
+				}
+				stmt = nil
+			case tok == "'":
+				return p.fail("unterminated initial packet")
+			default:
+				stmt = append(stmt, tok)
+			}
+		}
+		if err := p.statement(stmt); err != nil {
+			return err
+		}
+	}
+	// processes can be declared after their ports are exported, so only now
+	// are all the types known to map port names to pins
+	for i, port := range p.ports {
+		name := p.conf.Labels[i].Internal
+		p.conf.Labels[i].Internal = name + "." + p.pin(name, port)
+	}
+	return nil
+}
+
+// Parse one statement: an export, or a chain of connections.
+func (p *fbpParser) statement(tokens []string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	if m := fbpExport.FindStringSubmatch(tokens[0]); m != nil {
+		if len(tokens) > 1 {
+			return p.fail("unexpected %q after %s", tokens[1], m[1])
+		}
+		p.mark("labels", len(p.conf.Labels))
+		p.conf.Labels = append(p.conf.Labels, labelDef{External: m[4], Internal: m[2]})
+		p.ports = append(p.ports, m[3])
+		return nil
+	}
+	if strings.HasPrefix(tokens[0], "INPORT=") || strings.HasPrefix(tokens[0], "OUTPORT=") {
+		return p.fail("cannot parse %q, expected PORT=process.PORT:NAME", tokens[0])
+	}
+
+	// split into elements around the arrows
+	elements := [][]string{{}}
+	for _, tok := range tokens {
+		if tok == "->" {
+			elements = append(elements, []string{})
+		} else {
+			elements[len(elements)-1] = append(elements[len(elements)-1], tok)
+		}
+	}
+
+	from := ""      // output pin of the previous element
+	var iip Message // initial packet, if the chain starts with one
+	for i, elem := range elements {
+		first, last := i == 0, i == len(elements)-1
+		if first && len(elem) == 1 && strings.HasPrefix(elem[0], "'") {
+			if last {
+				return p.fail("initial packet is not sent anywhere")
+			}
+			iip = fbpValue(elem[0])
+			continue
+		}
+		var in, node, out string
+		switch {
+		case first && last && len(elem) == 1: // declaration only
+			node = elem[0]
+		case first && iip == nil && len(elem) == 2:
+			node, out = elem[0], elem[1]
+		case last && len(elem) == 2:
+			in, node = elem[0], elem[1]
+		case !first && !last && len(elem) == 3:
+			in, node, out = elem[0], elem[1], elem[2]
+		default:
+			return p.fail("cannot parse %q", strings.Join(elem, " "))
+		}
+		name, err := p.node(node)
+		if err != nil {
+			return err
+		}
+		if in != "" {
+			port, err := p.port(name, in)
+			if err != nil {
+				return err
+			}
+			if iip != nil {
+				p.mark("feeds", len(p.conf.Feeds))
+				p.conf.Feeds = append(p.conf.Feeds, feedDef{Data: iip, To: port})
+				iip = nil
+			} else {
+				p.mark("wires", len(p.conf.Wires))
+				p.conf.Wires = append(p.conf.Wires, wireDef{From: from, To: port})
+			}
+		}
+		if out != "" {
+			if from, err = p.port(name, out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Parse a process, with an optional component and metadata. Return its name.
+func (p *fbpParser) node(s string) (string, error) {
+	m := fbpNode.FindStringSubmatch(s)
+	if m == nil {
+		return "", p.fail("cannot parse process %q", s)
+	}
+	name, typ, meta := m[1], m[3], m[5]
+	if m[2] == "" {
+		if p.types[name] == "" {
+			return "", p.fail("process %s has no component", name)
+		}
+		return name, nil
+	}
+	if prev := p.types[name]; prev != "" && prev != typ {
+		return "", p.fail("process %s is already a %s", name, prev)
+	}
+	if p.types[name] == "" {
+		def := gadgetDef{Name: name, Type: typ}
+		for _, kv := range strings.Split(meta, ",") {
+			if kv == "" {
+				continue
+			}
+			fields := strings.SplitN(kv, "=", 2)
+			switch {
+			case fields[0] == "replicas" && len(fields) == 2:
+				def.Replicas, _ = strconv.Atoi(fields[1])
+			case fields[0] == "ordered":
+				def.Ordered = len(fields) == 1 || fields[1] == "true"
+			}
+		}
+		p.mark("gadgets", len(p.conf.Gadgets))
+		p.conf.Gadgets = append(p.conf.Gadgets, def)
+		p.types[name] = typ
+	}
+	return name, nil
+}
+
+// Parse a port, and return it as a pin of the named process.
+func (p *fbpParser) port(name, s string) (string, error) {
+	if !fbpPort.MatchString(s) {
+		return "", p.fail("cannot parse port %q", s)
+	}
+	return name + "." + p.pin(name, s), nil
+}
+
+// Map an FBP port name to the pin of a process, i.e. "OUT[x]" to "Out:x".
+func (p *fbpParser) pin(name, port string) string {
+	m := fbpPort.FindStringSubmatch(port)
+	if m == nil {
+		return port
+	}
+	pin := m[1]
+	if typ := p.types[name]; Registry[typ] != nil {
+		names, _ := typePins(typ) // cached, without creating a gadget each time
+		for _, known := range names {
+			if strings.EqualFold(known, pin) {
+				pin = known
+				break
+			}
+		}
+	}
+	if m[3] != "" {
+		pin += ":" + m[3]
+	}
+	return pin
+}
+
+// Remember on which line an entry was defined.
+func (p *fbpParser) mark(list string, index int) {
+	p.lines[fmt.Sprintf("%s[%d]", list, index)] = p.line
+}
+
+// Return the names of all the pins of a gadget or circuit.
+func pinNames(c Circuitry) []string {
+	names := []string{}
+	if cc, ok := c.(*Circuit); ok {
+		for ext := range cc.labels {
+			names = append(names, ext)
+		}
+	} else if v := reflect.ValueOf(c).Elem(); v.Kind() == reflect.Struct {
+		for i := 0; i < v.NumField(); i++ {
+			switch v.Field(i).Type().String() {
+			case "flow.Input", "flow.Output", "map[string]flow.Output":
+				names = append(names, v.Type().Field(i).Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Convert the text of an initial packet to a message.
+func fbpValue(s string) Message {
+	s = s[1 : len(s)-1]
+	s = strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	var any interface{}
+	if json.Unmarshal([]byte(s), &any) == nil {
+		return any
+	}
+	return s
+}
+
+// Convert a message to the text of an initial packet.
+func fbpQuote(m Message) string {
+	s, ok := m.(string)
+	if !ok {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return ""
+		}
+		s = string(data)
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// WriteFBP writes the circuit in FBP notation, so it can be loaded back in
+// with LoadFBP. Wire capacities, tagged or timed feeds, sub-circuits which are
+// not in the registry, and other unregistered gadgets can't be represented,
+// these are listed as comments at the end.
+func (c *Circuit) WriteFBP(w io.Writer) error {
+	var buf bytes.Buffer
+	desc := c.describe()
+	types := map[string]string{}
+	declared := map[string]bool{}
+	skipped := []string{}
+	for _, g := range desc.Gadgets {
+		if g.Circuit != nil {
+			skipped = append(skipped, "sub-circuit "+g.Name)
+			continue
+		}
+		types[g.Name] = g.Type
+		if g.Replicas > 1 {
+			types[g.Name] += fmt.Sprintf(":replicas=%d", g.Replicas)
+			if g.Ordered {
+				types[g.Name] += ",ordered"
+			}
+		}
+	}
+	node := func(name string) string {
+		if !declared[name] && types[name] != "" {
+			declared[name] = true
+			return name + "(" + types[name] + ")"
+		}
+		return name
+	}
+	port := func(pin string) string {
+		ppfv := strings.SplitN(pinPart(pin), ":", 2)
+		port := strings.ToUpper(ppfv[0])
+		if len(ppfv) > 1 {
+			port += "[" + ppfv[1] + "]"
+		}
+		return port
+	}
+
+	for _, wd := range desc.Wires {
+		from, to := gadgetPart(wd.From), gadgetPart(wd.To)
+		if types[from] == "" || types[to] == "" {
+			skipped = append(skipped, "wire "+wd.From+" -> "+wd.To)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s %s -> %s %s\n",
+			node(from), port(wd.From), port(wd.To), node(to))
+		if wd.Capacity > 0 {
+			skipped = append(skipped, fmt.Sprintf("capacity %d of %s -> %s",
+				wd.Capacity, wd.From, wd.To))
+		}
+		if wd.Durable != "" {
+			skipped = append(skipped, fmt.Sprintf("durable %s of %s -> %s",
+				wd.Durable, wd.From, wd.To))
+		}
+		if wd.Rate > 0 {
+			skipped = append(skipped, fmt.Sprintf("rate limit of %s -> %s",
+				wd.From, wd.To))
+		}
+	}
+	for _, f := range desc.Feeds {
+		to := gadgetPart(f.To)
+		if f.After != "" || f.At != "" || f.Every != "" {
+			skipped = append(skipped, "timed feed to "+f.To)
+			continue
+		}
+		if f.Tag != "" || types[to] == "" {
+			skipped = append(skipped, "feed to "+f.To)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s -> %s %s\n", fbpQuote(f.Data), port(f.To), node(to))
+	}
+	for _, g := range desc.Gadgets {
+		if types[g.Name] != "" && !declared[g.Name] {
+			fmt.Fprintln(&buf, node(g.Name))
+		}
+	}
+	for _, l := range desc.Labels {
+		kind := "INPORT"
+		if !c.isInput(l.Internal) {
+			kind = "OUTPORT"
+		}
+		fmt.Fprintf(&buf, "%s=%s.%s:%s\n",
+			kind, gadgetPart(l.Internal), port(l.Internal), l.External)
+	}
+	for _, name := range desc.Unregistered {
+		skipped = append(skipped, "unregistered gadget "+name)
+	}
+	for _, s := range skipped {
+		fmt.Fprintln(&buf, "# cannot express", s)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,128 @@
+package flow_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func ExampleCircuit_LoadFBP() {
+	g := flow.NewCircuit()
+	err := g.LoadFBP([]byte(`
+		# repeat a message three times, then count them
+		'3' -> NUM r(Repeater) OUT -> IN c(Counter)
+		'abc' -> IN r
+		c OUT -> IN p(Printer)
+	`))
+	flow.Check(err)
+	g.Run()
+	// Output:
+	// 3
+}
+
+func TestWriteFBP(t *testing.T) {
+	g := flow.NewCircuit()
+	g.Add("r", "Repeater")
+	g.Add("c", "Counter")
+	g.AddPool("p", "Pipe", 2, true)
+	g.Add("d", "Dispatcher")
+	g.Connect("r.Out", "c.In", 0)
+	g.Connect("c.Out", "p.In", 3)
+	g.Feed("r.Num", 3)
+	g.Feed("r.In", "it's")
+	g.Label("In", "r.In")
+	g.Label("Out", "p.Out")
+
+	var buf bytes.Buffer
+	if err := g.WriteFBP(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `r(Repeater) OUT -> IN c(Counter)
+c OUT -> IN p(Pipe:replicas=2,ordered)
+'it\'s' -> IN r
+'3' -> NUM r
+d(Dispatcher)
+INPORT=r.IN:In
+OUTPORT=p.OUT:Out
+# cannot express capacity 3 of c.Out -> p.In
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	g2 := flow.NewCircuit()
+	if err := g2.LoadFBP(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	var buf2 bytes.Buffer
+	g2.WriteFBP(&buf2)
+	if buf2.String() != strings.Replace(expected, "# cannot express capacity 3 of c.Out -> p.In\n", "", 1) {
+		t.Errorf("round trip mismatch:\n%s", buf2.String())
+	}
+}
+
+func TestLoadFBPExportsFirst(t *testing.T) {
+	inner := flow.NewCircuit()
+	err := inner.LoadFBP([]byte(`
+		INPORT=r.IN:IN
+		OUTPORT=c.OUT:OUT
+		'2' -> NUM r(Repeater) OUT -> IN c(Counter)
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []flow.Message
+	g := flow.NewCircuit()
+	g.AddCircuitry("s", inner)
+	g.AddCircuitry("t", flow.Transformer(func(m flow.Message) flow.Message {
+		out = append(out, m)
+		return m
+	}))
+	g.Add("x", "Sink")
+	g.Connect("s.OUT", "t.In", 0)
+	g.Connect("t.Out", "x.In", 0)
+	g.Feed("s.IN", "abc")
+	g.Run()
+	if len(out) != 1 || out[0] != 2 {
+		t.Errorf("expected [2], got %v", out)
+	}
+}
+
+func TestLoadFBPErrors(t *testing.T) {
+	tests := []struct{ data, want string }{
+		{"a(Pipe) OUT -> IN b", "line 1: process b has no component"},
+		{"\n'abc -> IN a(Pipe)", "line 2: unterminated initial packet"},
+		{"a(Pipe) OUT -> b(Pipe)", `line 1: cannot parse "b(Pipe)"`},
+		{"a(Pipe)\nb(Nope)", "line 2: gadgets[1]: unknown gadget type: Nope"},
+		{"a(Pipe)\n\nINPORT=x.IN:In", "line 3: labels[0]: gadget not found for: x.IN"},
+	}
+	for i, test := range tests {
+		err := flow.NewCircuit().LoadFBP([]byte(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%d: expected %q, got: %v", i, test.want, err)
+		}
+	}
+}
+
+func TestLoadFBPPinCache(t *testing.T) {
+	created := 0
+	flow.Registry["FBPCounted"] = func() flow.Circuitry {
+		created++
+		return flow.Registry["Pipe"]()
+	}
+	err := flow.NewCircuit().LoadFBP([]byte(`
+		a(FBPCounted) OUT -> IN b(FBPCounted) OUT -> IN c(FBPCounted)
+		c OUT -> IN d(Printer)
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// at most one to find out about the pins, and then one for each process
+	if created > 4 {
+		t.Errorf("expected at most 4 gadgets to be created, got %d", created)
+	}
+}
@@ -1,16 +1,16 @@
 package flow
 
 import (
-	"bufio"
 	"encoding/json"
         "errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"reflect"
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/golang/glog"
 )
@@ -21,7 +21,9 @@ var Version = "0.4.0"
 // The registry is the factory for all known types of gadgets.
 var Registry = map[string]func() Circuitry{}
 
-// Config stores configuration settings for general use.
+// Config stores configuration settings for general use. It is filled in by
+// LoadConfig, but not updated afterwards: use Configuration for typed access,
+// layered sources, and change notification.
 var Config = map[string]string{}
 
 // Messages are the generic type sent to, between, and from gadgets.
@@ -52,37 +54,176 @@ type Circuitry interface {
 
 // A wire is a ref-counted Input, it's closed when the count drops to 0.
 type wire struct {
+	sent     uint64     // number of messages sent, first for atomic alignment
+	timeouts uint64     // number of sends which timed out
+	limited  uint64     // number of sends held up by the rate limit
+	dropped  uint64     // number of messages dropped by the rate limit
+	mu       sync.Mutex // protects senders, so the channel is closed only once
 	channel  chan Message
 	senders  int
+	closed   bool
 	capacity int
 	dest     *Gadget
+	durable  string     // file for a durable wire, see ConnectDurable
+	queue    *diskQueue // opened once a durable wire is used
+	taps     []chan Message
+	ntaps    int32        // number of taps, checked without locking
+	profiled bool         // messages carry the time they were sent
+	limiter  atomic.Value // holds a *tokenBucket if there is a rate limit
 }
 
 // Send on a wire, returns ErrClosedOutput if the channel
 func (c *wire) Send(v Message) error {
-	return c.dest.sendTo(c, v)
+	return c.dest.sendTo(c, v, nil)
+}
+
+func (c *wire) connect() {
+	c.mu.Lock()
+	c.senders++
+	c.mu.Unlock()
 }
 
 func (c *wire) Disconnect() {
+	c.mu.Lock()
 	c.senders--
-	if c.senders == 0 && c.channel != nil {
-		close(c.channel)
+	c.mu.Unlock()
+	c.closeIfUnused()
+}
+
+func (c *wire) closeIfUnused() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.senders == 0 && !c.closed {
+		c.closed = true
+		c.closeTaps()
+		if c.durable == "" {
+			close(c.channel)
+		} else if c.queue != nil {
+			c.queue.close() // the channel is closed once all has been delivered
+		}
 	}
 }
 
+// Close all taps, so their readers know that nothing more will come. The caller
+// must hold the lock.
+func (c *wire) closeTaps() {
+	for _, tap := range c.taps {
+		close(tap)
+	}
+	c.taps = nil
+	atomic.StoreInt32(&c.ntaps, 0)
+}
+
+// Return true if the wire is still open, i.e. its receiver can get messages.
+func (c *wire) isOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed
+}
+
 var ErrClosedOutput = errors.New("output is closed")
 
-// Use a fake sink for every output pin not connected to anything else.
-type fakeSink struct{}
+// An outlet ties one output pin to the wire it sends to. Outlets can be moved
+// to another wire while the circuit is running, see Circuit.Reload. An outlet
+// which is not attached to any wire acts as a fake sink: messages get lost.
+type outlet struct {
+	sent    uint64 // number of messages sent, first for atomic alignment
+	lost    uint64 // number of messages lost because nothing was connected
+	mu      sync.RWMutex
+	move    sync.Mutex // serialises moves
+	wire    *wire
+	retired chan struct{} // closed to release a send blocked on the old wire
+	closed  bool          // set once the sending gadget has been replaced
+	owner   *Gadget       // the gadget which sends through this outlet
+}
+
+var errRetired = errors.New("outlet moved to another wire")
+var errDropped = errors.New("message dropped by the rate limit")
 
-func (c *fakeSink) Send(m Message) error {
-        _, file, line, _ := runtime.Caller(1)
-        file = file[strings.LastIndex(file, "/")+1:]
-	glog.Warningf("Lost %T in %s:%d: %v\n", m, file, line, m)
-        return nil
+func (o *outlet) Send(v Message) error {
+	if o.owner != nil && o.owner.owner.profile != nil {
+		defer o.owner.owner.profile.sending(o.owner)()
+	}
+	for {
+		o.mu.RLock()
+		if o.wire == nil {
+			closed := o.closed
+			o.mu.RUnlock()
+			if closed {
+				return ErrClosedOutput
+			}
+			atomic.AddUint64(&o.lost, 1)
+			lostMessage(v)
+			return nil
+		}
+		err := o.wire.dest.send(o.wire, v, o.retired)
+		o.mu.RUnlock()
+		switch err {
+		case nil:
+			atomic.AddUint64(&o.sent, 1)
+		case errDropped:
+			return nil // not sent, but this is not an error for the sender
+		}
+		if err != errRetired {
+			return err
+		}
+	}
+}
+
+func (o *outlet) Disconnect() {
+	o.moveTo(nil)
+}
+
+// Move the outlet to a different wire, or detach it if the new wire is nil.
+func (o *outlet) moveTo(w *wire) {
+	o.move.Lock()
+	defer o.move.Unlock()
+	if w != nil && o.wire == w {
+		return // disconnecting first would close the wire
+	}
+	if o.retired != nil {
+		close(o.retired)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.wire != nil {
+		o.wire.Disconnect()
+	}
+	o.wire = w
+	if w != nil {
+		w.connect()
+	}
+	o.retired = make(chan struct{})
+}
+
+// Detach the outlet for good, all further sends fail with ErrClosedOutput.
+func (o *outlet) retire() {
+	o.moveTo(nil)
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+}
+
+// Return the wire the outlet currently sends to, or nil if it is not attached.
+func (o *outlet) target() *wire {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.wire
+}
+
+// Return true once the outlet has been retired.
+func (o *outlet) isClosed() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.closed
 }
 
-func (c *fakeSink) Disconnect() {}
+// Report a message sent to an output pin which is not connected to anything.
+func lostMessage(m Message) {
+	_, file, line, _ := runtime.Caller(2)
+	file = file[strings.LastIndex(file, "/")+1:]
+	glog.Warningf("Lost %T in %s:%d: %v\n", m, file, line, m)
+}
 
 // extract "a" from "a.b", panics if there's no dot in the string
 func gadgetPart(s string) string {
@@ -122,38 +263,82 @@ func Check(err interface{}) {
 // Call this as "defer flow.DontPanic()" for a concise stack trace on panics.
 // The circuit is being passed in so we can Abort() on the circuit
 func DontPanic(c *Circuit) {
-	// generate a nice stack trace, see https://code.google.com/p/gonicetrace/
 	if e := recover(); e != nil {
-		glog.Errorf("***** PANIC: %v", e)
-		fmt.Fprintf(os.Stderr, "\nPANIC: %v\n", e)
-                BackTrace()
-                c.Abort()
+		reportPanic(c, e)
 	}
 }
 
-// AddToRegistry adds circuit definitions from a JSON file to the registry.
+// Same as DontPanic, but also counts the panic for this gadget.
+func (g *Gadget) dontPanic() {
+	if e := recover(); e != nil {
+		atomic.AddUint32(&g.panics, 1)
+		reportPanic(g.owner, e)
+	}
+}
+
+func reportPanic(c *Circuit, e interface{}) {
+	// generate a nice stack trace, see https://code.google.com/p/gonicetrace/
+	glog.Errorf("***** PANIC: %v", e)
+	fmt.Fprintf(os.Stderr, "\nPANIC: %v\n", e)
+	BackTrace()
+	c.Abort()
+}
+
+// AddToRegistry adds circuit definitions from a file to the registry. The file
+// can be in JSON, YAML, or TOML format, as determined by its extension. Other
+// files can be imported from it, see the package documentation. A name which
+// is already in the registry can only be defined again by the same file, so
+// redefining a built-in gadget, or a name from another file, is an error. All
+// the definitions are checked right away, and all problems are returned
+// together, in which case the registry is left as is. The circuits themselves
+// are only created once they are used.
 func AddToRegistry(filename string) error {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+	_, err := addToRegistry(filename, false)
+	return err
+}
+
+// AddToRegistryStrict is like AddToRegistry, but also validates all the
+// definitions against the JSON Schema, as LoadJSONStrict does. Unknown fields,
+// such as a misspelled "wires", are then reported as errors.
+func AddToRegistryStrict(filename string) error {
+	_, err := addToRegistry(filename, true)
+	return err
+}
+
+// ValidateFile checks a setup file in the same way as AddToRegistryStrict, but
+// leaves the registry as is, so that several files can define the same names.
+func ValidateFile(filename string) error {
+	undo, err := addToRegistry(filename, true)
+	if err == nil {
+		undo()
 	}
-	var definitions map[string]json.RawMessage
-	err = json.Unmarshal(data, &definitions)
-	if err != nil {
-		return err
+	return err
+}
+
+// Add the definitions from a file to the registry, and return a function to
+// take them out again.
+func addToRegistry(filename string, strict bool) (undo func(), err error) {
+	r := &registryLoader{
+		origin: map[string]string{},
+		files:  map[string]map[string]*definition{},
+		defs:   map[string]*definition{},
+		strict: strict,
 	}
-	for name, def := range definitions {
-		registerCircuit(name, def)
+	if err := r.load(filename, nil); err != nil {
+		return nil, err
 	}
-	return nil
+	undo = r.install() // they refer to each other, so check them in place
+	if err := r.validate(); err != nil {
+		undo()
+		return nil, err
+	}
+	return undo, nil
 }
 
-func registerCircuit(name string, def []byte) {
+func registerCircuit(name string, def *definition) {
+	definitions[name] = def
 	Registry[name] = func() Circuitry {
-		g := NewCircuit()
-		err := g.LoadJSON(def)
-		Check(err)
-		return g
+		return newWithParams(def, nil)
 	}
 }
 
@@ -189,33 +374,17 @@ func PrintDescription(c Circuitry) {
 // LoadConfig parses a configuration file, if it exists, to set up some basic
 // application settings, such as where the app/ and data/ directories are.
 // Settings can be overridden through environment variables with the same name.
-func LoadConfig(defaults, filename string) {
-	parseSettingsLine := func(line string) {
-		line = strings.TrimSpace(line)
-		if line != "" && !strings.HasPrefix(line, "#") {
-			fields := strings.SplitN(line, "=", 2)
-			if len(fields) != 2 {
-				panic(fmt.Errorf("cannot parse configuration: %s", line))
-			}
-			key := strings.TrimSpace(fields[0])
-			value := strings.TrimSpace(fields[1])
-			env := os.Getenv(key)
-			if env != "" {
-				value = env
-			}
-			Config[key] = value
-		}
+// The results are stored in Configuration, and copied to Config.
+func LoadConfig(defaults, filename string) error {
+	if err := Configuration.SetDefaults(defaults); err != nil {
+		return err
 	}
-
-	for _, s := range strings.Split(defaults, "\n") {
-		parseSettingsLine(s)
+	err := Configuration.AddFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
-
-	if fd, err := os.Open(filename); err == nil {
-		defer fd.Close()
-		scanner := bufio.NewScanner(fd)
-		for scanner.Scan() {
-			parseSettingsLine(scanner.Text())
-		}
+	for k, v := range Configuration.All() {
+		Config[k] = v
 	}
+	return nil
 }
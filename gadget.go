@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -14,8 +16,15 @@ type Gadget struct {
 	circuitry Circuitry        // pointer to self as a Circuitry object
 	name      string           // name of this gadget in the circuit
 	owner     *Circuit         // owning circuit
-	inputs    map[string]*wire // inbound wires
-	outputs   map[string]*wire // outbound wires
+	inputs    map[string]*wire   // inbound wires
+	outputs   map[string]*outlet // outbound connections
+	launched  bool               // true once the gadget has been started
+	done      chan struct{}      // closed when the gadget has finished
+	removed   chan struct{}      // closed when the gadget is dropped by Reload
+	finish    sync.Once          // the circuit stops waiting for it only once
+	stopOnce  sync.Once          // sets up the channel returned by Aborted
+	stopped   chan struct{}      // closed on abort or when removed
+	panics    uint32             // number of times Run has panicked
 }
 
 func (g *Gadget) initGadget(cy Circuitry, nm string, ow *Circuit) *Gadget {
@@ -26,7 +35,7 @@ func (g *Gadget) initGadget(cy Circuitry, nm string, ow *Circuit) *Gadget {
 	g.name = nm
 	g.owner = ow
 	g.inputs = map[string]*wire{}
-	g.outputs = map[string]*wire{}
+	g.outputs = map[string]*outlet{}
 	return g
 }
 
@@ -48,6 +57,28 @@ func (g *Gadget) Abort() {
         g.owner.Abort()
 }
 
+// Aborted returns a channel which is closed when the circuit is aborted, or
+// when the gadget has been removed from it by Reload, so that gadgets which
+// wait for something else than their inputs can stop.
+func (g *Gadget) Aborted() <-chan struct{} {
+	if g.removed == nil {
+		return g.owner.abort // not launched yet, so it can't be removed
+	}
+	g.stopOnce.Do(func() {
+		g.stopped = make(chan struct{})
+		go func() {
+			select {
+			case <-g.owner.abort:
+			case <-g.removed:
+			case <-g.done:
+				return
+			}
+			close(g.stopped)
+		}()
+	})
+	return g.stopped
+}
+
 func (g *Gadget) pinValue(pin string) reflect.Value {
 	pp := pinPart(pin)
 	// if it's a circuit, look up mapped pins
@@ -67,10 +98,15 @@ func (g *Gadget) getInput(pin string, capacity int) *wire {
 	c := g.inputs[pin]
 	if c == nil {
 		c = &wire{channel: make(chan Message, capacity), dest: g}
+		c.profiled = g.owner.profile != nil && !g.launched
 		g.inputs[pin] = c
 	}
-	if capacity > c.capacity {
+	// the channel can only be resized while nothing is listening on it yet
+	if capacity > c.capacity && !g.launched {
 		c.capacity = capacity
+		if c.durable == "" {
+			c.channel = make(chan Message, capacity)
+		}
 	}
 	return c
 }
@@ -82,7 +118,10 @@ func (g *Gadget) setOutput(pin string, c *wire) {
 		if !fp.IsNil() {
 			glog.Fatalf("output already connected: %s.%s", g.name, pin)
 		}
-		setValue(fp, c)
+		o := &outlet{owner: g}
+		o.moveTo(c)
+		setValue(fp, o)
+		g.outputs[pin] = o
 	} else { // it's not an Output, so it must be a map[string]Output
 		if fp.IsNil() {
 			setValue(fp, map[string]Output{})
@@ -91,39 +130,54 @@ func (g *Gadget) setOutput(pin string, c *wire) {
 		if _, ok := outputs[ppfv[1]]; ok {
 			glog.Fatalf("output already connected: %s.%s", g.name, pin)
 		}
-		outputs[ppfv[1]] = c
+		o := &outlet{owner: g}
+		o.moveTo(c)
+		outputs[ppfv[1]] = o
+		g.outputs[pin] = o
 	}
-	c.senders++
-	g.outputs[pin] = c
 }
 
 func (g *Gadget) setupChannels() {
 	// make sure all the feed wires have also been set up
 	for dest, msgs := range g.owner.feeds {
 		if gadgetPart(dest) == g.name {
-			g.getInput(dest, len(msgs)) // will add wire to the inputs map
+			w := g.getInput(dest, len(msgs)) // will add wire to the inputs map
+			w.profiled = g.owner.profile != nil
+		}
+	}
+	for dest := range g.owner.timed {
+		if gadgetPart(dest) == g.name {
+			w := g.getInput(dest, 0)
+			w.profiled = g.owner.profile != nil
 		}
 	}
 
 	// set up and pre-fill all the input pins
 	for pin, wire := range g.inputs {
-		// create a channel with the proper capacity
-		wire.channel = make(chan Message, wire.capacity)
-		setValue(g.circuitry.pinValue(pin), wire.channel)
+		if wire.profiled {
+			setValue(g.circuitry.pinValue(pin), g.relay(wire))
+		} else {
+			setValue(g.circuitry.pinValue(pin), wire.channel)
+		}
+		if wire.durable != "" {
+			g.startDelivery(wire)
+		}
 		// fill it with messages from the feed inbox, if any
 		for _, msg := range g.owner.feeds[pin] {
 			wire.channel <- msg
 		}
-		// close the channel if there is no other feed
-		if wire.senders == 0 {
-			close(wire.channel)
+		for _, f := range g.owner.timed[pin] {
+			g.sendScheduled(wire, f)
 		}
+		// close the channel if there is no other feed
+		wire.closeIfUnused()
 	}
 
 	// set dangling inputs to a null input and dangling outputs to a fake sink
 	gadget := g.gadgetValue()
 	for i := 0; i < gadget.NumField(); i++ {
 		field := gadget.Field(i)
+		name := gadget.Type().Field(i).Name
 		switch field.Type().String() {
 		case "flow.Input":
 			if field.IsNil() {
@@ -133,7 +187,9 @@ func (g *Gadget) setupChannels() {
 			}
 		case "flow.Output":
 			if field.IsNil() {
-				setValue(field, &fakeSink{})
+				o := &outlet{owner: g} // not attached, can still be connected later
+				setValue(field, o)
+				g.outputs[name] = o
 			}
 		}
 	}
@@ -141,14 +197,49 @@ func (g *Gadget) setupChannels() {
 
 func (g *Gadget) closeChannels() {
         // close outputs since we won't be outputting anymore
-	for _, wire := range g.outputs {
-		wire.Disconnect()
+	for _, o := range g.outputs {
+		o.Disconnect()
 	}
         // don't close input because consumers should never close input channels,
         // see http://blog.golang.org/pipelines
 }
 
-func (g *Gadget) sendTo(w *wire, v Message) error {
+// Send a message on a wire. A send can be cut short by closing the retired
+// channel, in which case errRetired is returned and nothing has been sent. A
+// message dropped by the rate limit of the wire is not reported as an error.
+func (g *Gadget) sendTo(w *wire, v Message, retired chan struct{}) error {
+	if err := g.send(w, v, retired); err != errDropped {
+		return err
+	}
+	return nil
+}
+
+// Send a message on a wire, as sendTo does, but return errDropped if the rate
+// limit of the wire dropped the message.
+func (g *Gadget) send(w *wire, v Message, retired chan struct{}) error {
+	if b := w.rateLimiter(); b != nil {
+		if err := g.throttle(w, b, retired); err != nil {
+			return err
+		}
+	}
+	err := g.trySend(w, v, retired)
+	if err == nil {
+		w.delivered(v)
+	}
+	return err
+}
+
+func (g *Gadget) trySend(w *wire, v Message, retired chan struct{}) error {
+	if w.durable != "" {
+		q, err := w.diskQueue(false)
+		if err != nil {
+			return err
+		}
+		return q.put(v) // never blocks
+	}
+	if w.profiled {
+		v = timedMessage{v, time.Now()}
+	}
 	const reportSlowSends = true
 	if reportSlowSends {
                 // be optimistic and assume we can just send, this is done because the
@@ -158,6 +249,8 @@ func (g *Gadget) sendTo(w *wire, v Message) error {
                         return ErrClosedOutput
                 case w.channel <- v:
                         return nil // send ok
+                case <-retired:
+                        return errRetired
                 default:
                 }
                 // didn't work, start a timer and try again
@@ -167,7 +260,10 @@ func (g *Gadget) sendTo(w *wire, v Message) error {
                         return ErrClosedOutput
                 case w.channel <- v:
                         return nil // send ok
+                case <-retired:
+                        return errRetired
                 case <-timer:
+                        atomic.AddUint64(&w.timeouts, 1)
                         glog.Errorln("send timed out", g.name, v)
                         return fmt.Errorf("Send to %s timed out", g.name)
                 }
@@ -177,23 +273,50 @@ func (g *Gadget) sendTo(w *wire, v Message) error {
                         return ErrClosedOutput
                 case w.channel <- v:
                         return nil // send ok
+                case <-retired:
+                        return errRetired
                 }
 	}
 }
 
 func (g *Gadget) launch() {
+	g.launched = true
+	g.done = make(chan struct{})
+	g.removed = make(chan struct{})
 	g.owner.wait.Add(1)
 	g.setupChannels()
 
 	go func() {
-		defer DontPanic(g.owner)
-		defer g.owner.wait.Done()
+		defer g.dontPanic()
+		defer g.finish.Do(g.owner.wait.Done)
+		defer close(g.done)
 		defer g.closeChannels()
 
 		g.circuitry.Run()
 	}()
 }
 
+// Drop a gadget from its circuit: its outputs are retired, it is told to stop
+// through Aborted, and the circuit no longer waits for it to finish. This also
+// applies to all the gadgets inside it, if it is a circuit.
+func (g *Gadget) remove() {
+	for _, o := range g.outputs {
+		o.retire()
+	}
+	if !g.launched {
+		return
+	}
+	close(g.removed)
+	if sub, ok := g.circuitry.(*Circuit); ok {
+		sub.mu.Lock()
+		for _, x := range sub.gadgets {
+			x.remove()
+		}
+		sub.mu.Unlock()
+	}
+	g.finish.Do(g.owner.wait.Done)
+}
+
 func setValue(value reflect.Value, any interface{}) {
 	value.Set(reflect.ValueOf(any))
 }
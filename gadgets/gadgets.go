@@ -8,13 +8,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 	"code.google.com/p/go.exp/fsnotify" // supposedly will be std in Go1.3
 
         "github.com/golang/glog"
 	"github.com/jcw/flow"
 	_ "github.com/jcw/flow/gadgets/pipe"
+	_ "github.com/jcw/flow/gadgets/remote"
 
 )
 
@@ -35,6 +38,7 @@ func init() {
 	flow.Registry["ReadFileText"] = func() flow.Circuitry { return new(ReadFileText) }
 	flow.Registry["ReadFileJSON"] = func() flow.Circuitry { return new(ReadFileJSON) }
 	flow.Registry["EnvVar"] = func() flow.Circuitry { return new(EnvVar) }
+	flow.Registry["Config"] = func() flow.Circuitry { return new(Config) }
 	flow.Registry["CmdLine"] = func() flow.Circuitry { return new(CmdLine) }
 	flow.Registry["Concat3"] = func() flow.Circuitry { return new(Concat3) }
 	flow.Registry["AddTag"] = func() flow.Circuitry { return new(AddTag) }
@@ -80,13 +84,14 @@ func (w *Repeater) Run() {
 	}
 }
 
-// A counter reports the number of messages it has received.
-// Registers as "Counter".
+// A counter reports the number of messages it has received. Its count can be
+// saved and restored with checkpoints. Registers as "Counter".
 type Counter struct {
 	flow.Gadget
 	In  flow.Input
 	Out flow.Output
 
+	mu    sync.Mutex
 	count int
 }
 
@@ -96,10 +101,26 @@ func (w *Counter) Run() {
 		if _, ok := m.(flow.Tag); ok {
 			w.Out.Send(m) // don't count tags, just pass them through
 		} else {
+			w.mu.Lock()
 			w.count++
+			w.mu.Unlock()
 		}
 	}
-	w.Out.Send(w.count)
+	w.Out.Send(w.Snapshot())
+}
+
+// Snapshot returns the current count.
+func (w *Counter) Snapshot() flow.Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// Restore continues counting from a previously saved count.
+func (w *Counter) Restore(state flow.Message) {
+	if n, ok := state.(int); ok {
+		w.count = n
+	}
 }
 
 // Printers report the messages sent to them as output. Registers as "Printer".
@@ -157,15 +178,23 @@ type Clock struct {
 	Out flow.Output
 }
 
-// Start sending out periodic messages, once the rate is known.
+// Start sending out periodic messages, once the rate is known. This goes on
+// until the output is closed, or the gadget is stopped.
 func (w *Clock) Run() {
 	if r, ok := <-w.In; ok {
 		rate, err := time.ParseDuration(r.(string))
 		flow.Check(err)
 		t := time.NewTicker(rate)
 		defer t.Stop()
-		for m := range t.C {
-			w.Out.Send(m)
+		for {
+			select {
+			case m := <-t.C:
+				if w.Out.Send(m) != nil {
+					return
+				}
+			case <-w.Aborted():
+				return
+			}
 		}
 	}
 }
@@ -348,6 +377,90 @@ func (g *EnvVar) Run() {
 	}
 }
 
+// Lookup a configuration setting, with optional default. Settings are taken from
+// flow.Configuration, or else from flow.Config. If a poll interval such as "1s"
+// is sent to Watch, the configuration files are checked for changes and new
+// values are sent out again, also after In has been closed, until the circuit is
+// aborted or the gadget is removed. Registers as "Config".
+type Config struct {
+	flow.Gadget
+	In    flow.Input
+	Watch flow.Input
+	Out   flow.Output
+}
+
+// Look up one setting, as string or as flow.Tag with a default value.
+func configValue(m flow.Message) flow.Message {
+	key, def := "", flow.Message("")
+	switch v := m.(type) {
+	case string:
+		key = v
+	case flow.Tag:
+		key, def = v.Tag, v.Msg
+	default:
+		return m
+	}
+	if s, ok := flow.Configuration.Get(key); ok {
+		return s
+	}
+	if s, ok := flow.Config[key]; ok {
+		return s
+	}
+	return def
+}
+
+// Look up settings as they come in, and if requested, keep watching them until
+// the circuit is aborted or the gadget is removed.
+func (g *Config) Run() {
+	var changed chan struct{}
+	if m, ok := <-g.Watch; ok {
+		s, _ := m.(string)
+		if interval, err := time.ParseDuration(s); err != nil || interval <= 0 {
+			glog.Warningln("config: invalid watch interval, ignored:", m)
+		} else {
+			changed = make(chan struct{}, 1)
+			remove := flow.Configuration.OnChange(func([]string) {
+				select {
+				case changed <- struct{}{}:
+				default: // already pending
+				}
+			})
+			defer remove()
+			stop := flow.Configuration.WatchFiles(interval, func(err error) {
+				glog.Errorln("config:", err)
+			})
+			defer stop()
+		}
+	}
+
+	in := g.In
+	keys, last := []flow.Message{}, []flow.Message{}
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				if changed == nil || len(keys) == 0 {
+					return // nothing left to watch
+				}
+				in = nil // no more keys, but keep watching the ones we have
+				continue
+			}
+			keys = append(keys, m)
+			last = append(last, configValue(m))
+			g.Out.Send(last[len(last)-1])
+		case <-changed:
+			for i, m := range keys {
+				if v := configValue(m); !reflect.DeepEqual(v, last[i]) {
+					last[i] = v
+					g.Out.Send(v)
+				}
+			}
+		case <-g.Aborted():
+			return
+		}
+	}
+}
+
 // Turn command-line arguments into a message flow. Registers as "CmdLine".
 type CmdLine struct {
 	flow.Gadget
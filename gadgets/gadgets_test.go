@@ -1,8 +1,10 @@
 package gadgets
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/jcw/flow"
 )
@@ -157,6 +159,96 @@ func ExampleEnvVar() {
 	// Lost string: abc
 }
 
+func ExampleConfig() {
+	defer func(saved *flow.Settings) { flow.Configuration = saved }(flow.Configuration)
+	flow.Configuration = flow.NewSettings()
+	flow.Configuration.Set("DATA_DIR", "/data")
+
+	g := flow.NewCircuit()
+	g.Add("c", "Config")
+	g.Add("p", "Printer")
+	g.Connect("c.Out", "p.In", 0)
+	g.Feed("c.In", "DATA_DIR")
+	g.Feed("c.In", flow.Tag{"DATA_DIR", "def"})
+	g.Feed("c.In", flow.Tag{"BLAH", "abc"})
+	g.Run()
+	// Output:
+	// /data
+	// /data
+	// abc
+}
+
+func TestConfigWatch(t *testing.T) {
+	defer func(saved *flow.Settings) { flow.Configuration = saved }(flow.Configuration)
+	flow.Configuration = flow.NewSettings()
+	file, err := ioutil.TempFile("", "flow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("WATCHED = one\n")
+	file.Close()
+	flow.Check(flow.Configuration.AddFile(file.Name()))
+
+	results := make(chan flow.Message, 10)
+	g := flow.NewCircuit()
+	g.Add("c", "Config")
+	g.AddCircuitry("t", flow.Transformer(func(m flow.Message) flow.Message {
+		results <- m
+		return m
+	}))
+	g.Connect("c.Out", "t.In", 0)
+	g.Feed("c.Watch", "10ms")
+	g.Feed("c.In", "WATCHED")
+	done := make(chan struct{})
+	go func() {
+		g.Run() // keeps running while watching, even though In is closed
+		close(done)
+	}()
+
+	expect := func(want string) {
+		select {
+		case m := <-results:
+			if m != want {
+				t.Errorf("expected %s, got %v", want, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s", want)
+		}
+	}
+	expect("one")
+	ioutil.WriteFile(file.Name(), []byte("WATCHED = two\n"), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(file.Name(), later, later)
+	expect("two")
+	ioutil.WriteFile(file.Name(), []byte("WATCHED = three\n"), 0644)
+	later = later.Add(time.Second)
+	os.Chtimes(file.Name(), later, later)
+	expect("three")
+
+	select {
+	case <-done:
+		t.Fatal("circuit finished while still watching")
+	default:
+	}
+	g.Abort() // watching stops once the circuit is aborted
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("circuit did not finish")
+	}
+}
+
+func TestConfigWatchInvalid(t *testing.T) {
+	g := flow.NewCircuit()
+	g.Add("c", "Config")
+	g.Add("s", "Sink")
+	g.Connect("c.Out", "s.In", 0)
+	g.Feed("c.Watch", 123)
+	g.Feed("c.In", flow.Tag{"NOT_SET", "abc"})
+	g.Run() // must not panic, and must finish
+}
+
 func ExampleConcat3() {
 	g := flow.NewCircuit()
 	g.Add("t1", "Timer")
@@ -0,0 +1,367 @@
+// Gadgets to connect circuits in different processes over a network socket.
+package remote
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jcw/flow"
+)
+
+func init() {
+	flow.Registry["RemoteOut"] = func() flow.Circuitry { return new(RemoteOut) }
+	flow.Registry["RemoteIn"] = func() flow.Circuitry { return new(RemoteIn) }
+}
+
+// Maximum size of one encoded message.
+const maxFrame = 16 << 20
+
+// Delays between attempts to re-establish a lost connection.
+var (
+	RetryMin = 100 * time.Millisecond
+	RetryMax = 5 * time.Second
+)
+
+// Split an address such as "tcp://host:port", "unix:///path/to/socket", or
+// just "host:port" into network and address.
+func splitAddr(addr string) (string, string) {
+	if n := strings.Index(addr, "://"); n >= 0 {
+		return addr[:n], addr[n+3:]
+	}
+	return "tcp", addr
+}
+
+// Look up the codec to use, sent as name on the given pin, default is JSON.
+func getCodec(pin flow.Input) flow.Codec {
+	name := "json"
+	if m, ok := <-pin; ok {
+		name = m.(string)
+	}
+	codec := flow.Codecs[name]
+	if codec == nil {
+		flow.Check(fmt.Errorf("unknown codec: %s", name))
+	}
+	return codec
+}
+
+// Each message is sent as a frame: its length as 4-byte big-endian integer,
+// followed by the encoded message.
+func writeFrame(w io.Writer, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrame {
+		return nil, fmt.Errorf("frame too large: %d bytes", n)
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+// RemoteOut sends all incoming messages to a RemoteIn gadget in another
+// process, at the address sent to Addr, e.g. "localhost:2000". A lost
+// connection is re-established, and messages which were not acknowledged yet
+// are sent again, so messages can arrive twice but are not lost. At most
+// Window messages (default 10) are in transit, after that RemoteOut stops
+// accepting messages. The codec can be set by name on Codec, default "json".
+// Registers as "RemoteOut".
+type RemoteOut struct {
+	flow.Gadget
+	Addr   flow.Input
+	Codec  flow.Input
+	Window flow.Input
+	In     flow.Input
+}
+
+// Start sending messages, and wait until they have all been acknowledged, or
+// until the circuit is aborted.
+func (g *RemoteOut) Run() {
+	network, addr := splitAddr((<-g.Addr).(string))
+	codec := getCodec(g.Codec)
+	window := 10
+	switch m := (<-g.Window).(type) {
+	case int:
+		window = m
+	case float64: // from JSON
+		window = int(m)
+	}
+	if window < 1 {
+		window = 1
+	}
+
+	s := &sender{network: network, addr: addr, window: window, abort: g.Aborted()}
+	s.cond = sync.NewCond(&s.mu)
+	finished := make(chan struct{})
+	defer close(finished)
+	go s.watchAbort(finished)
+	for m := range g.In {
+		data, err := codec.Encode(m)
+		flow.Check(err)
+		if !s.send(data) {
+			return
+		}
+	}
+	s.flush()
+}
+
+// A sender keeps track of unacknowledged frames, and re-sends them when the
+// connection has to be re-established.
+type sender struct {
+	network, addr string
+	window        int
+	abort         <-chan struct{} // closed when the circuit is aborted
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	conn    net.Conn
+	pending [][]byte // sent, but not acknowledged yet
+	broken  bool     // set when the current connection fails
+	aborted bool     // set once abort has been closed, to stop all waiting
+}
+
+// Wake up everything waiting on the sender when the circuit is aborted.
+func (s *sender) watchAbort(finished chan struct{}) {
+	select {
+	case <-s.abort:
+	case <-finished:
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = true
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.cond.Broadcast()
+}
+
+// Connect, retrying until it succeeds, and re-send all pending frames. Must be
+// called with the lock held. Returns false if the circuit has been aborted.
+func (s *sender) connect() bool {
+	delay := RetryMin
+	for !s.aborted {
+		conn, err := net.Dial(s.network, s.addr)
+		if err == nil {
+			w := bufio.NewWriter(conn)
+			for _, data := range s.pending {
+				if err = writeFrame(w, data); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = w.Flush()
+			}
+			if err == nil {
+				s.conn, s.broken = conn, false
+				go s.readAcks(conn)
+				return true
+			}
+			conn.Close()
+		}
+		glog.Warningln("remote:", err)
+		s.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-s.abort:
+		}
+		s.mu.Lock()
+		if delay *= 2; delay > RetryMax {
+			delay = RetryMax
+		}
+	}
+	return false
+}
+
+// Each acknowledgement is a single byte, it releases the oldest pending frame.
+func (s *sender) readAcks(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		_, err := r.ReadByte()
+		s.mu.Lock()
+		if s.conn != conn {
+			s.mu.Unlock()
+			return // stale connection, already replaced
+		}
+		if err != nil {
+			s.broken = true
+		} else if len(s.pending) > 0 {
+			s.pending = s.pending[1:]
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Re-establish the connection if needed. Must be called with the lock held.
+// Returns false if the circuit has been aborted.
+func (s *sender) ensure() bool {
+	if s.aborted {
+		return false
+	}
+	if s.conn == nil || s.broken {
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return s.connect()
+	}
+	return true
+}
+
+// Send a frame, returns false if the circuit has been aborted.
+func (s *sender) send(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.pending) >= s.window {
+		if !s.ensure() {
+			return false
+		}
+		if len(s.pending) >= s.window && !s.broken {
+			s.cond.Wait() // backpressure: wait until the receiver catches up
+		}
+	}
+	if !s.ensure() {
+		return false
+	}
+	s.pending = append(s.pending, data)
+	if err := writeFrame(s.conn, data); err != nil {
+		s.broken = true // will be re-sent after reconnecting
+	}
+	return true
+}
+
+// Wait until all frames have been acknowledged, then close the connection.
+func (s *sender) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.pending) > 0 && s.ensure() {
+		if len(s.pending) > 0 && !s.broken {
+			s.cond.Wait()
+		}
+	}
+	if s.conn != nil {
+		conn := s.conn
+		s.conn = nil
+		conn.Close()
+	}
+}
+
+// RemoteIn listens on the address sent to Addr, e.g. ":2000" or
+// "unix:///tmp/flow.sock", and sends out all messages received from RemoteOut
+// gadgets. Each message is acknowledged once it has been sent out, so a slow
+// circuit will also slow down the senders. The codec must be the same as used
+// by the sender. Registers as "RemoteIn".
+type RemoteIn struct {
+	flow.Gadget
+	Addr  flow.Input
+	Codec flow.Input
+	Out   flow.Output
+}
+
+// Start listening, this gadget keeps running until the listener fails, or the
+// circuit is aborted.
+func (g *RemoteIn) Run() {
+	network, addr := splitAddr((<-g.Addr).(string))
+	codec := getCodec(g.Codec)
+	ln, err := net.Listen(network, addr)
+	flow.Check(err)
+
+	var mu sync.Mutex // only one connection sends out at a time
+	var handlers sync.WaitGroup
+	conns := map[net.Conn]bool{} // nil once closing down
+	finished := make(chan struct{})
+	defer func() {
+		close(finished)
+		handlers.Wait() // they must not send out once this gadget has ended
+	}()
+	go func() { // closing the listener and all connections ends everything
+		select {
+		case <-g.Aborted():
+		case <-finished:
+		}
+		ln.Close()
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+		mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-g.Aborted():
+			default:
+				glog.Errorln("remote:", err)
+			}
+			return
+		}
+		mu.Lock()
+		if conns == nil {
+			mu.Unlock()
+			conn.Close()
+			return
+		}
+		conns[conn] = true
+		mu.Unlock()
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			defer func() {
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				conn.Close()
+			}()
+			r := bufio.NewReader(conn)
+			for {
+				data, err := readFrame(r)
+				if err != nil {
+					if err != io.EOF {
+						glog.Warningln("remote:", err)
+					}
+					return
+				}
+				m, err := codec.Decode(data)
+				if err != nil {
+					glog.Errorln("remote:", err)
+					return
+				}
+				mu.Lock()
+				err = g.Out.Send(m)
+				mu.Unlock()
+				if err != nil { // not acknowledged, so the sender will retry
+					glog.Warningln("remote:", err)
+					return
+				}
+				if _, err := conn.Write([]byte{1}); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,149 @@
+package remote_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets/remote"
+)
+
+// Send messages from one circuit to another, starting the sender first so that
+// it has to retry until the receiver is listening.
+func testRemote(t *testing.T, addr string) {
+	out := flow.NewCircuit()
+	out.Add("o", "RemoteOut")
+	out.Feed("o.Addr", addr)
+	out.Feed("o.Window", 2)
+	for i := 0; i < 20; i++ {
+		out.Feed("o.In", fmt.Sprint("msg", i))
+	}
+	done := make(chan struct{})
+	go func() {
+		out.Run()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	results := make(chan flow.Message)
+	in := flow.NewCircuit()
+	in.Add("i", "RemoteIn")
+	in.AddCircuitry("t", flow.Transformer(func(m flow.Message) flow.Message {
+		results <- m
+		return m
+	}))
+	in.Connect("i.Out", "t.In", 0)
+	in.Feed("i.Addr", addr)
+	go in.Run() // keeps listening
+
+	for i := 0; i < 20; i++ {
+		select {
+		case m := <-results:
+			if m != fmt.Sprint("msg", i) {
+				t.Errorf("expected msg%d, got %v", i, m)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for msg%d", i)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sender did not finish")
+	}
+}
+
+func TestRemoteTCP(t *testing.T) {
+	testRemote(t, "tcp://"+freeAddr(t))
+}
+
+func TestRemoteUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testRemote(t, "unix://"+filepath.Join(dir, "flow.sock"))
+}
+
+// A receiver which takes longer than the send timeout must not lose messages.
+func TestRemoteSlowReceiver(t *testing.T) {
+	addr := "tcp://" + freeAddr(t)
+	results := make(chan flow.Message, 10)
+	in := flow.NewCircuit()
+	in.Add("i", "RemoteIn")
+	in.AddCircuitry("t", flow.Transformer(func(m flow.Message) flow.Message {
+		if m == "msg0" {
+			time.Sleep(1200 * time.Millisecond) // Out of RemoteIn times out
+		}
+		results <- m
+		return m
+	}))
+	in.Connect("i.Out", "t.In", 0)
+	in.Feed("i.Addr", addr)
+	go in.Run()
+	defer in.Abort()
+
+	out := flow.NewCircuit()
+	out.Add("o", "RemoteOut")
+	out.Feed("o.Addr", addr)
+	for i := 0; i < 5; i++ {
+		out.Feed("o.In", fmt.Sprint("msg", i))
+	}
+	go out.Run()
+	defer out.Abort()
+
+	for i := 0; i < 5; {
+		select {
+		case m := <-results:
+			if m == fmt.Sprint("msg", i) {
+				i++
+			} else if m != fmt.Sprint("msg", i-1) { // duplicates are allowed
+				t.Fatalf("expected msg%d, got %v", i, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for msg%d", i)
+		}
+	}
+}
+
+// Both gadgets must stop once their circuit is aborted, even if they are still
+// listening or trying to connect.
+func TestRemoteAbort(t *testing.T) {
+	addr := "tcp://" + freeAddr(t)
+	for _, typ := range []string{"RemoteIn", "RemoteOut"} {
+		g := flow.NewCircuit()
+		g.Add("r", typ)
+		g.Feed("r.Addr", addr)
+		if typ == "RemoteOut" {
+			g.Feed("r.In", "never sent")
+		}
+		done := make(chan struct{})
+		go func() {
+			g.Run()
+			close(done)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		g.Abort()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("%s did not stop after abort", typ)
+		}
+	}
+}
+
+// Return a local TCP address which is not in use.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
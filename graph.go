@@ -0,0 +1,197 @@
+package flow
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A graph is a drawing-oriented view of a circuit, with one cluster for each
+// sub-circuit. It is used to generate Graphviz and Mermaid output.
+type graph struct {
+	ids   map[string]string // maps gadget and pin paths to node ids
+	top   graphCluster
+	edges []graphEdge
+}
+
+type graphCluster struct {
+	id    string
+	label string
+	nodes []graphNode
+	subs  []*graphCluster
+}
+
+type graphNode struct {
+	id    string
+	label []string // one entry per line
+	kind  string   // "gadget", "pin", or "feed"
+}
+
+type graphEdge struct {
+	from, to, label string
+}
+
+// Return the node id for a path, allocating a new one if needed.
+func (g *graph) id(path string) string {
+	if g.ids[path] == "" {
+		g.ids[path] = fmt.Sprintf("n%d", len(g.ids)+1)
+	}
+	return g.ids[path]
+}
+
+// Build the graph of a circuit, which has the given path prefix.
+func (g *graph) add(c *Circuit, cl *graphCluster, prefix string) {
+	desc := c.describe()
+	pools := map[string]bool{}
+	for _, d := range desc.Gadgets {
+		pools[d.Name] = d.Replicas > 1
+	}
+	// return the node on which a wire to or from a pin should end
+	endpoint := func(pin string) string {
+		name := gadgetPart(pin)
+		if _, ok := c.gadgets[name].circuitry.(*Circuit); ok && !pools[name] {
+			pin = strings.SplitN(pinPart(pin), ":", 2)[0]
+			return g.id(prefix + name + ".<pin>" + pin)
+		}
+		return g.id(prefix + name)
+	}
+
+	for _, d := range desc.Gadgets {
+		sub, ok := c.gadgets[d.Name].circuitry.(*Circuit)
+		switch {
+		case ok && !pools[d.Name]:
+			subcl := &graphCluster{id: g.id(prefix + d.Name), label: d.Name}
+			if d.Type != "" {
+				subcl.label += ": " + d.Type
+			}
+			cl.subs = append(cl.subs, subcl)
+			g.add(sub, subcl, prefix+d.Name+".")
+		case pools[d.Name]:
+			pool := fmt.Sprintf("%s x%d", d.Type, d.Replicas)
+			if d.Ordered {
+				pool += " ordered"
+			}
+			cl.nodes = append(cl.nodes, graphNode{g.id(prefix + d.Name),
+				[]string{d.Name, pool}, "gadget"})
+		default:
+			cl.nodes = append(cl.nodes, graphNode{g.id(prefix + d.Name),
+				[]string{d.Name, d.Type}, "gadget"})
+		}
+	}
+	for _, name := range desc.Unregistered {
+		typ := fmt.Sprintf("%T", c.gadgets[name].circuitry)
+		cl.nodes = append(cl.nodes, graphNode{g.id(prefix + name),
+			[]string{name, strings.TrimPrefix(typ, "*")}, "gadget"})
+	}
+
+	for _, w := range desc.Wires {
+		label := pinPart(w.From) + " -> " + pinPart(w.To)
+		if w.Capacity > 0 {
+			label += fmt.Sprintf(" (%d)", w.Capacity)
+		}
+		g.edges = append(g.edges, graphEdge{endpoint(w.From), endpoint(w.To), label})
+	}
+	for i, f := range desc.Feeds {
+		id := g.id(fmt.Sprintf("%s<feed%d>", prefix, i))
+		text := fmt.Sprint(f.Data)
+		if f.Tag != "" {
+			text = f.Tag + ": " + text
+		}
+		if len(text) > 30 {
+			text = text[:27] + "..."
+		}
+		cl.nodes = append(cl.nodes, graphNode{id, []string{text}, "feed"})
+		g.edges = append(g.edges, graphEdge{id, endpoint(f.To), pinPart(f.To)})
+	}
+	for _, l := range desc.Labels {
+		id := g.id(prefix + "<pin>" + l.External)
+		cl.nodes = append(cl.nodes, graphNode{id, []string{l.External}, "pin"})
+		if c.isInput(l.Internal) {
+			g.edges = append(g.edges, graphEdge{id, endpoint(l.Internal), pinPart(l.Internal)})
+		} else {
+			g.edges = append(g.edges, graphEdge{endpoint(l.Internal), id, pinPart(l.Internal)})
+		}
+	}
+}
+
+// Return true if a pin, given as "gadget.pin", is an input.
+func (c *Circuit) isInput(pin string) bool {
+	pin = strings.SplitN(pin, ":", 2)[0]
+	return c.gadgetOf(pin).circuitry.pinValue(pin).Type().String() == "flow.Input"
+}
+
+func (c *Circuit) graph() *graph {
+	g := &graph{ids: map[string]string{}}
+	g.add(c, &g.top, "")
+	return g
+}
+
+// WriteDot writes the circuit as a Graphviz graph, in DOT format. Sub-circuits
+// are drawn as clusters, initial messages as notes, and external pins as ovals.
+// Wire capacities are shown in parentheses after the pin names.
+func (c *Circuit) WriteDot(w io.Writer) error {
+	var buf bytes.Buffer
+	g := c.graph()
+	buf.WriteString("digraph circuit {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	shapes := map[string]string{"pin": "oval", "feed": "note"}
+	var walk func(cl *graphCluster, indent string)
+	walk = func(cl *graphCluster, indent string) {
+		for _, n := range cl.nodes {
+			fmt.Fprintf(&buf, "%s%s [label=%s", indent, n.id,
+				dotQuote(strings.Join(n.label, "\n")))
+			if shape := shapes[n.kind]; shape != "" {
+				fmt.Fprintf(&buf, ", shape=%s", shape)
+			}
+			buf.WriteString("];\n")
+		}
+		for _, sub := range cl.subs {
+			fmt.Fprintf(&buf, "%ssubgraph cluster_%s {\n%s\tlabel=%s;\n",
+				indent, sub.id, indent, dotQuote(sub.label))
+			walk(sub, indent+"\t")
+			fmt.Fprintf(&buf, "%s}\n", indent)
+		}
+	}
+	walk(&g.top, "\t")
+	for _, e := range g.edges {
+		fmt.Fprintf(&buf, "\t%s -> %s [label=%s];\n", e.from, e.to, dotQuote(e.label))
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// WriteMermaid writes the circuit as a Mermaid flowchart, using the same
+// conventions as WriteDot. Sub-circuits become subgraphs.
+func (c *Circuit) WriteMermaid(w io.Writer) error {
+	var buf bytes.Buffer
+	g := c.graph()
+	buf.WriteString("flowchart LR\n")
+	shapes := map[string]string{"gadget": "[%s]", "pin": "([%s])", "feed": ">%s]"}
+	var walk func(cl *graphCluster, indent string)
+	walk = func(cl *graphCluster, indent string) {
+		for _, n := range cl.nodes {
+			label := mermaidQuote(strings.Join(n.label, "<br/>"))
+			fmt.Fprintf(&buf, "%s%s"+shapes[n.kind]+"\n", indent, n.id, label)
+		}
+		for _, sub := range cl.subs {
+			fmt.Fprintf(&buf, "%ssubgraph %s [%s]\n", indent, sub.id, mermaidQuote(sub.label))
+			walk(sub, indent+"    ")
+			fmt.Fprintf(&buf, "%send\n", indent)
+		}
+	}
+	walk(&g.top, "    ")
+	for _, e := range g.edges {
+		fmt.Fprintf(&buf, "    %s -->|%s| %s\n", e.from, mermaidQuote(e.label), e.to)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func mermaidQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, "#quot;", -1) + `"`
+}
@@ -0,0 +1,70 @@
+package flow_test
+
+import (
+	"os"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func graphExample() *flow.Circuit {
+	sub := flow.NewCircuit()
+	sub.Add("r", "Repeater")
+	sub.Feed("r.Num", 2)
+	sub.Label("In", "r.In")
+	sub.Label("Out", "r.Out")
+
+	g := flow.NewCircuit()
+	g.Add("p", "Pipe")
+	g.AddCircuitry("sub", sub)
+	g.Connect("p.Out", "sub.In", 5)
+	g.Feed("p.In", "abc")
+	g.Label("Out", "sub.Out")
+	return g
+}
+
+func ExampleCircuit_WriteDot() {
+	graphExample().WriteDot(os.Stdout)
+	// Output:
+	// digraph circuit {
+	// 	rankdir=LR;
+	// 	node [shape=box];
+	// 	n1 [label="p\nPipe"];
+	// 	n7 [label="abc", shape=note];
+	// 	n8 [label="Out", shape=oval];
+	// 	subgraph cluster_n2 {
+	// 		label="sub";
+	// 		n3 [label="r\nRepeater"];
+	// 		n4 [label="2", shape=note];
+	// 		n5 [label="In", shape=oval];
+	// 		n6 [label="Out", shape=oval];
+	// 	}
+	// 	n4 -> n3 [label="Num"];
+	// 	n5 -> n3 [label="In"];
+	// 	n3 -> n6 [label="Out"];
+	// 	n1 -> n5 [label="Out -> In (5)"];
+	// 	n7 -> n1 [label="In"];
+	// 	n6 -> n8 [label="Out"];
+	// }
+}
+
+func ExampleCircuit_WriteMermaid() {
+	graphExample().WriteMermaid(os.Stdout)
+	// Output:
+	// flowchart LR
+	//     n1["p<br/>Pipe"]
+	//     n7>"abc"]
+	//     n8(["Out"])
+	//     subgraph n2 ["sub"]
+	//         n3["r<br/>Repeater"]
+	//         n4>"2"]
+	//         n5(["In"])
+	//         n6(["Out"])
+	//     end
+	//     n4 -->|"Num"| n3
+	//     n5 -->|"In"| n3
+	//     n3 -->|"Out"| n6
+	//     n1 -->|"Out -> In (5)"| n5
+	//     n7 -->|"In"| n1
+	//     n6 -->|"Out"| n8
+}
@@ -0,0 +1,284 @@
+package flow
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// One entry in the import list of a setup file.
+type importDef struct {
+	File     string // relative to the importing file, can be a glob pattern
+	Optional bool   // don't complain if there is no such file
+}
+
+// Convert a decoded import list, which can contain plain file names as well as
+// objects of the form { "file": "...", "optional": true }.
+func importDefs(v interface{}) ([]importDef, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	imports := []importDef{}
+	for _, item := range list {
+		switch item := item.(type) {
+		case string:
+			imports = append(imports, importDef{File: item})
+		case map[string]interface{}:
+			file, _ := item["file"].(string)
+			optional, _ := item["optional"].(bool)
+			if file == "" {
+				return nil, fmt.Errorf("import has no file: %v", item)
+			}
+			imports = append(imports, importDef{file, optional})
+		default:
+			return nil, fmt.Errorf("cannot import: %v", item)
+		}
+	}
+	return imports, nil
+}
+
+// The setup file which each registry entry was added from, to detect conflicts
+// between calls to AddToRegistry. Built-in gadgets have no origin.
+var registryOrigins = map[string]string{}
+
+// A registryLoader adds the definitions from a setup file and all the files it
+// imports to the registry, each file is only loaded once.
+type registryLoader struct {
+	origin map[string]string                 // file which defined each name
+	files  map[string]map[string]*definition // definitions in each file
+	defs   map[string]*definition            // to register once all is well
+	strict bool                              // also validate against the schema
+}
+
+// Load a file, the stack lists the files which are importing it.
+func (r *registryLoader) load(filename string, stack []string) error {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	for i, f := range stack {
+		if f == path {
+			cycle := []string{}
+			for _, f := range append(stack[i:], path) {
+				cycle = append(cycle, filepath.Base(f))
+			}
+			return fmt.Errorf("%s: import cycle: %s",
+				filename, strings.Join(cycle, " -> "))
+		}
+	}
+	if r.files[path] != nil {
+		return nil // already loaded
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	defs, imports, err := parseDefinitions(filename, data)
+	if err != nil {
+		return err
+	}
+	r.files[path] = defs
+	stack = append(stack, path)
+
+	for _, imp := range imports {
+		pattern := imp.File
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return &DefinitionError{File: filename, Path: "import", Msg: err.Error()}
+		}
+		if len(matches) == 0 && !imp.Optional {
+			return &DefinitionError{File: filename, Path: "import",
+				Msg: "no such file: " + imp.File}
+		}
+		for _, m := range matches {
+			if err := r.load(m, stack); err != nil {
+				return err
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := r.register(name, defs[name], filename); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if err := r.resolveTypes(defs[name], filename, stack); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Register a definition, unless another file has already used that name, in
+// this import or in an earlier one, or it is the name of a built-in gadget:
+// redefining those is an error, unless RemoveFromRegistry is called first.
+// Entries for types which refer to another file use that file as origin.
+func (r *registryLoader) register(name string, def *definition, filename string) error {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	prev := r.origin[name]
+	if prev == "" && Registry[name] != nil {
+		prev = registryOrigins[name]
+		if prev == "" {
+			return fmt.Errorf("%s: %s is already a built-in gadget", filename, name)
+		}
+	}
+	if prev != "" && prev != path {
+		return fmt.Errorf("%s: %s is already defined in %s", filename, name, prev)
+	}
+	r.origin[name] = path
+	r.defs[name] = def
+	return nil
+}
+
+// Add all the definitions which have been loaded to the registry. Returns a
+// function to put back the previous registry entries.
+func (r *registryLoader) install() (undo func()) {
+	type entry struct {
+		factory func() Circuitry
+		def     *definition
+		origin  string
+	}
+	saved := map[string]entry{}
+	for name, def := range r.defs {
+		saved[name] = entry{Registry[name], definitions[name], registryOrigins[name]}
+		registerCircuit(name, def)
+		registryOrigins[name] = r.origin[name]
+	}
+	return func() {
+		for name, e := range saved {
+			delete(Registry, name)
+			delete(definitions, name)
+			delete(registryOrigins, name)
+			if e.factory != nil {
+				Registry[name] = e.factory
+			}
+			if e.def != nil {
+				definitions[name] = e.def
+			}
+			if e.origin != "" {
+				registryOrigins[name] = e.origin
+			}
+		}
+	}
+}
+
+// RemoveFromRegistry takes gadget types out of the registry again, including
+// circuits added by AddToRegistry, after which any file can define them anew.
+func RemoveFromRegistry(names ...string) {
+	for _, name := range names {
+		delete(Registry, name)
+		delete(definitions, name)
+		delete(registryOrigins, name)
+	}
+}
+
+// Gadget types of the form "file#circuit" refer to a circuit defined in
+// another file, relative to the current one. Load that file and register the
+// circuit under this type name.
+func (r *registryLoader) resolveTypes(def *definition, filename string, stack []string) error {
+	conf, err := def.decode()
+	if err != nil {
+		return nil // will be reported once the circuit is used
+	}
+	for _, typ := range gadgetTypes(conf) {
+		n := strings.LastIndex(typ, "#")
+		if n < 0 || strings.Contains(typ, "${") {
+			continue
+		}
+		file, name := typ[:n], typ[n+1:]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(filename), file)
+		}
+		path, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		if r.files[path] == nil {
+			if err := r.load(file, stack); err != nil {
+				return err
+			}
+		}
+		target := r.files[path][name]
+		if target == nil {
+			return fmt.Errorf("%s: no circuit %s in %s", filename, name, file)
+		}
+		// a conflict only arises if the same type leads to different files
+		if err := r.register(typ, target, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return all the gadget types used in a definition, including sub-circuits.
+func gadgetTypes(conf *config) []string {
+	types := []string{}
+	for _, g := range conf.Gadgets {
+		if g.Circuit != nil {
+			types = append(types, gadgetTypes(g.Circuit)...)
+		} else if g.Type != "" {
+			types = append(types, g.Type)
+		}
+	}
+	return types
+}
+
+// Check all the definitions which have been loaded. Each error path starts
+// with the name of the definition, e.g. "main.wires[2]".
+func (r *registryLoader) validate() error {
+	var errs DefinitionErrors
+	files := []string{}
+	for path := range r.files {
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	for _, path := range files {
+		defs := r.files[path]
+		names := []string{}
+		for name := range defs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var err error
+			if r.strict {
+				err = defs[name].validate()
+			}
+			if err == nil {
+				_, err = NewCircuit().prepare(defs[name], true)
+			}
+			switch e := err.(type) {
+			case nil:
+			case DefinitionErrors:
+				for _, de := range e {
+					de.Path = strings.TrimSuffix(name+"."+de.Path, ".")
+				}
+				errs = append(errs, e...)
+			case *DefinitionError:
+				e.Path = strings.TrimSuffix(name+"."+e.Path, ".")
+				errs = append(errs, e)
+			default:
+				errs = append(errs, &DefinitionError{Path: name, Msg: err.Error()})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
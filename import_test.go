@@ -0,0 +1,163 @@
+package flow_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+// Write a set of files to a fresh temporary directory, and return its name.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "flow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range files {
+		filename := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		if err := ioutil.WriteFile(filename, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestImport(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.json": `{
+			"import": [ "lib/*.yaml", { "file": "local.json", "optional": true } ],
+			"importMain": {
+				"gadgets": [
+					{ "name": "a", "type": "importA" },
+					{ "name": "f", "type": "parts/filters.json#importFilter" }
+				]
+			}
+		}`,
+		"lib/a.yaml":         "importA:\n  gadgets:\n    - { name: p, type: importB }\n",
+		"lib/b.yaml":         "importB:\n  gadgets:\n    - { name: p, type: Pipe }\n",
+		"parts/filters.json": `{ "importFilter": { "gadgets": [ { "name": "p", "type": "Pipe" } ] } }`,
+	})
+	defer os.RemoveAll(dir)
+
+	if err := flow.AddToRegistry(filepath.Join(dir, "main.json")); err != nil {
+		t.Fatal(err)
+	}
+	defer flow.RemoveFromRegistry("importMain", "importA", "importB", "importFilter",
+		"parts/filters.json#importFilter")
+	for _, name := range []string{"importMain", "importA", "importB",
+		"parts/filters.json#importFilter"} {
+		if flow.Registry[name] == nil {
+			t.Errorf("%s not registered", name)
+		}
+	}
+	if flow.Registry["importFilter"] == nil {
+		t.Error("other definitions of a referenced file should be registered")
+	}
+	flow.Registry["importMain"]() // must not fail
+}
+
+func TestImportErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"cycle1.json":   `{ "import": "cycle2.json" }`,
+		"cycle2.json":   `{ "import": [ "cycle1.json" ] }`,
+		"missing.json":  `{ "import": [ "nope.json" ] }`,
+		"conflict.json": `{ "import": [ "other.json" ], "dup": {} }`,
+		"other.json":    `{ "dup": {} }`,
+		"ref.json":      `{ "x": { "gadgets": [ { "name": "p", "type": "other.json#nope" } ] } }`,
+	})
+	defer os.RemoveAll(dir)
+
+	tests := []struct{ file, want string }{
+		{"cycle1.json", "import cycle: cycle1.json -> cycle2.json -> cycle1.json"},
+		{"missing.json", "missing.json: import: no such file: nope.json"},
+		{"conflict.json", "dup is already defined in"},
+		{"ref.json", "no circuit nope in"},
+	}
+	for _, test := range tests {
+		err := flow.AddToRegistry(filepath.Join(dir, test.file))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: expected %q, got: %v", test.file, test.want, err)
+		}
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"first.json":   `{ "conflictA": {} }`,
+		"second.json":  `{ "conflictA": {}, "conflictB": {} }`,
+		"builtin.json": `{ "Pipe": {} }`,
+	})
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.json")
+	if err := flow.AddToRegistry(first); err != nil {
+		t.Fatal(err)
+	}
+	defer flow.RemoveFromRegistry("conflictA")
+	if err := flow.AddToRegistry(first); err != nil {
+		t.Errorf("loading the same file again: %v", err)
+	}
+	err := flow.AddToRegistry(filepath.Join(dir, "second.json"))
+	if err == nil || !strings.Contains(err.Error(), "conflictA is already defined in") {
+		t.Errorf("expected conflict, got: %v", err)
+	}
+	if flow.Registry["conflictB"] != nil {
+		t.Error("conflictB should not have been registered")
+	}
+	flow.RemoveFromRegistry("conflictA")
+	if err := flow.AddToRegistry(filepath.Join(dir, "second.json")); err != nil {
+		t.Errorf("redefining a removed name: %v", err)
+	}
+	defer flow.RemoveFromRegistry("conflictB")
+	err = flow.AddToRegistry(filepath.Join(dir, "builtin.json"))
+	if err == nil || !strings.Contains(err.Error(), "Pipe is already a built-in gadget") {
+		t.Errorf("expected built-in conflict, got: %v", err)
+	}
+}
+
+func TestAddToRegistryValidation(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"setup.json": `{
+			"valid": {
+				"params": { "T": "Pipe" },
+				"gadgets": [ { "name": "p", "type": "${T}" } ],
+				"wires": [ { "from": "p.Out", "to": "${TARGET}" } ]
+			},
+			"broken": {
+				"gadgets": [
+					{ "name": "p", "type": "Pipe" },
+					{ "name": "q", "type": "Nope" },
+					{ "name": "s", "type": "valid" }
+				],
+				"wires": [
+					{ "from": "p.Out", "to": "p.Inn" },
+					{ "from": "p.Out", "to": "s.In" }
+				]
+			}
+		}`,
+	})
+	defer os.RemoveAll(dir)
+
+	err := flow.AddToRegistry(filepath.Join(dir, "setup.json"))
+	errs, ok := err.(flow.DefinitionErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got: %v", err)
+	}
+	for i, want := range []string{
+		"line 10: broken.gadgets[1]: unknown gadget type: Nope",
+		"line 14: broken.wires[0]: unknown pin: p.Inn",
+		"line 15: broken.wires[1]: unknown pin: s.In",
+	} {
+		if !strings.HasSuffix(errs[i].Error(), want) {
+			t.Errorf("expected %q, got: %v", want, errs[i])
+		}
+	}
+	if flow.Registry["valid"] != nil || flow.Registry["broken"] != nil {
+		t.Error("registry should be left as is")
+	}
+}
@@ -1,48 +1,432 @@
 package flow
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// The definition of a circuit, as used by LoadJSON and returned by Describe.
 type config struct {
-	Gadgets []struct {
-		Type, Name string
+	Gadgets      []gadgetDef       `json:"gadgets,omitempty"`
+	Wires        []wireDef         `json:"wires,omitempty"`
+	Feeds        []feedDef         `json:"feeds,omitempty"`
+	Labels       []labelDef        `json:"labels,omitempty"`
+	Unregistered []string          `json:"unregistered,omitempty"` // can't be re-created
+	Params       map[string]string `json:"params,omitempty"`       // default values
+}
+
+// definition of one initial message
+type feedDef struct {
+	Tag   string  `json:"tag,omitempty"`
+	Data  Message `json:"data"`
+	To    string  `json:"to"`
+	After string  `json:"after,omitempty"` // delay after start, for a timed feed
+	At    string  `json:"at,omitempty"`    // or an absolute time, in RFC 3339
+	Every string  `json:"every,omitempty"` // repeat interval
+}
+
+// definition of one external pin
+type labelDef struct {
+	External string `json:"external"`
+	Internal string `json:"internal"`
+}
+
+// A DefinitionError reports a problem with one entry in a circuit definition.
+// The path identifies the entry, e.g. "gadgets[2]", the line is 0 if unknown.
+type DefinitionError struct {
+	File string
+	Line int
+	Path string
+	Msg  string
+}
+
+func (e *DefinitionError) Error() string {
+	s := e.Msg
+	if e.Path != "" {
+		s = e.Path + ": " + s
+	}
+	if e.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", e.Line, s)
 	}
-	Wires []struct {
-		From, To string
-		Capacity int
+	if e.File != "" {
+		s = e.File + ": " + s
 	}
-	Feeds []struct {
-		Tag  string
-		Data interface{}
-		To   string
+	return s
+}
+
+// DefinitionErrors collects all the problems found in a circuit definition.
+type DefinitionErrors []*DefinitionError
+
+func (e DefinitionErrors) Error() string {
+	lines := []string{}
+	for _, err := range e {
+		lines = append(lines, err.Error())
 	}
-	Labels []struct {
-		External, Internal string
+	return strings.Join(lines, "\n")
+}
+
+// A definition can decode a fresh copy of one circuit definition from a file,
+// and knows on which line each entry of that definition starts.
+type definition struct {
+	file   string
+	decode func() (*config, error)
+	asJSON func() ([]byte, error) // for validation against the schema, if set
+	lines  map[string]int         // maps entry paths such as "wires[3]" to line numbers
+}
+
+// Find the line of an entry, or else of the closest entry which contains it.
+func (d *definition) lineOf(path string) int {
+	for path != "" && d.lines[path] == 0 {
+		path = path[:strings.LastIndexAny(path, ".[")+1]
+		path = strings.TrimRight(path, ".[")
 	}
+	return d.lines[path]
 }
 
 // Load a circuit from a JSON description in a string.
 func (c *Circuit) LoadJSON(data []byte) error {
-	var conf config
-	err := json.Unmarshal(data, &conf)
-	if err == nil {
-		for _, g := range conf.Gadgets {
+	return c.loadDefinition(jsonDefinition("", data, 0))
+}
+
+// Load a circuit from a definition, after checking all its entries.
+func (c *Circuit) loadDefinition(d *definition) error {
+	conf, err := c.prepare(d, false)
+	if err != nil {
+		return err
+	}
+	c.loadConfig(conf)
+	return nil
+}
+
+// Decode a definition, fill in its parameters, and check it. When lenient,
+// placeholders without a value are left as is, and not treated as errors.
+func (c *Circuit) prepare(d *definition, lenient bool) (*config, error) {
+	conf, err := d.decode()
+	if err != nil {
+		return nil, err
+	}
+	r := newParamResolver(c.params, conf.Params)
+	r.lenient = lenient
+	conf = r.config(conf, "")
+	errs := r.errs
+	if len(errs) == 0 {
+		errs = c.check(conf, "")
+	}
+	if len(errs) > 0 {
+		c.spares = nil
+		for _, e := range errs {
+			e.File = d.file
+			e.Line = d.lineOf(e.Path)
+		}
+		return nil, errs
+	}
+	return conf, nil
+}
+
+func (c *Circuit) loadConfig(conf *config) {
+	for _, g := range conf.Gadgets {
+		switch {
+		case g.Circuit != nil:
+			c.addSubCircuit(g.Name, g.Circuit)
+		case g.Replicas > 1:
+			c.AddPool(g.Name, g.Type, g.Replicas, g.Ordered)
+		case g.Params != nil:
+			c.AddWithParams(g.Name, g.Type, g.Params)
+		default:
 			c.Add(g.Name, g.Type)
 		}
-		for _, w := range conf.Wires {
-			c.Connect(w.From, w.To, w.Capacity)
+	}
+	for _, w := range conf.Wires {
+		c.connect(w)
+	}
+	for _, f := range conf.Feeds {
+		var m Message = f.Data
+		if f.Tag != "" {
+			m = Tag{f.Tag, f.Data}
+		}
+		if s, _ := f.schedule(); s != nil {
+			c.FeedScheduled(f.To, m, *s)
+		} else {
+			c.Feed(f.To, m)
+		}
+	}
+	for _, l := range conf.Labels {
+		c.Label(l.External, l.Internal)
+	}
+}
+
+// Check a definition before loading it into this circuit. Wires, feeds, and
+// labels may refer to gadgets which have already been added to the circuit.
+func (c *Circuit) check(conf *config, prefix string) DefinitionErrors {
+	var errs DefinitionErrors
+	fail := func(path, format string, args ...interface{}) {
+		errs = append(errs, &DefinitionError{
+			Path: prefix + path,
+			Msg:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	known := map[string]bool{}
+	pins := map[string][]string{} // pins of each gadget, if they can be found
+	for name, g := range c.gadgets {
+		known[name] = true
+		pins[name] = pinNames(g.circuitry)
+	}
+	for i, g := range conf.Gadgets {
+		path := fmt.Sprintf("gadgets[%d]", i)
+		switch {
+		case g.Name == "":
+			fail(path, "gadget has no name")
+		case strings.Contains(g.Name, "."):
+			fail(path, "gadget name should not include a dot: %s", g.Name)
+		case known[g.Name]:
+			fail(path, "duplicate gadget name: %s", g.Name)
+		}
+		known[g.Name] = true
+		switch {
+		case g.Circuit != nil:
+			errs = append(errs, NewCircuit().check(g.Circuit, prefix+path+".circuit.")...)
+			pins[g.Name] = labelNames(g.Circuit)
+		case g.Type == "":
+			fail(path, "gadget %s has no type", g.Name)
+		case hasParam(g.Type):
+			// can't tell until the parameter has a value
+		case Registry[g.Type] == nil:
+			fail(path, "unknown gadget type: %s", g.Type)
+		case g.Params != nil && definitions[g.Type] == nil:
+			fail(path, "gadget type %s does not take parameters", g.Type)
+		default:
+			names, spare := typePins(g.Type)
+			pins[g.Name] = names
+			if spare != nil && g.Replicas <= 1 && g.Params == nil {
+				c.keepSpare(g.Type, spare)
+			}
+		}
+	}
+
+	checkPin := func(path, pin string) {
+		if hasParam(pin) {
+			return
+		}
+		if n := strings.IndexRune(pin, '.'); n <= 0 || n == len(pin)-1 {
+			fail(path, "pin should be of the form gadget.pin: %q", pin)
+		} else if !known[gadgetPart(pin)] {
+			fail(path, "gadget not found for: %s", pin)
+		} else if names := pins[gadgetPart(pin)]; names != nil {
+			p := strings.SplitN(pinPart(pin), ":", 2)[0]
+			if sort.SearchStrings(names, p) == len(names) ||
+				names[sort.SearchStrings(names, p)] != p {
+				fail(path, "unknown pin: %s", pin)
+			}
+		}
+	}
+	for i, w := range conf.Wires {
+		path := fmt.Sprintf("wires[%d]", i)
+		checkPin(path, w.From)
+		checkPin(path, w.To)
+		if w.Capacity < 0 {
+			fail(path, "capacity can't be negative: %d", w.Capacity)
+		}
+		if w.Rate < 0 || w.Burst < 0 {
+			fail(path, "rate and burst can't be negative")
+		} else if w.Rate == 0 && (w.Burst > 0 || w.Drop) {
+			fail(path, "burst and drop need a rate")
+		}
+	}
+	for i, f := range conf.Feeds {
+		path := fmt.Sprintf("feeds[%d]", i)
+		checkPin(path, f.To)
+		if hasParam(f.After) || hasParam(f.At) || hasParam(f.Every) {
+			continue
+		}
+		if _, err := f.schedule(); err != nil {
+			fail(path, "invalid schedule: %v", err)
+		}
+	}
+	for i, l := range conf.Labels {
+		path := fmt.Sprintf("labels[%d]", i)
+		if l.External == "" || strings.Contains(l.External, ".") {
+			fail(path, "invalid external pin name: %q", l.External)
+		}
+		checkPin(path, l.Internal)
+	}
+	return errs
+}
+
+// Return the sorted names of all the external pins of a circuit definition.
+func labelNames(conf *config) []string {
+	names := []string{}
+	for _, l := range conf.Labels {
+		names = append(names, l.External)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Return the pins of a registered gadget type, or nil if they are not known.
+// Circuits from setup files are not instantiated, their labels are used. If a
+// gadget had to be created to find out, it is returned as well.
+func typePins(typ string) ([]string, Circuitry) {
+	if def := definitions[typ]; def != nil {
+		conf, err := def.decode()
+		if err != nil {
+			return nil, nil
+		}
+		return labelNames(conf), nil
+	}
+	pins, g := goTypePins(typ)
+	names := []string{}
+	for _, p := range pins {
+		names = append(names, p.Name)
+	}
+	return names, g
+}
+
+// Keep a gadget which was created while checking a definition, so that it can
+// be used when the definition is loaded, instead of creating another one.
+func (c *Circuit) keepSpare(typ string, g Circuitry) {
+	if c.spares == nil {
+		c.spares = map[string][]Circuitry{}
+	}
+	c.spares[typ] = append(c.spares[typ], g)
+}
+
+// Create a gadget of the given type, or use a spare one of that type.
+func (c *Circuit) newGadget(typ string) Circuitry {
+	if spares := c.spares[typ]; len(spares) > 0 {
+		c.spares[typ] = spares[1:]
+		return spares[0]
+	}
+	return Registry[typ]()
+}
+
+// Parse a file with one or more named circuit definitions, and the list of
+// other files it imports. The format is determined by the extension: ".yaml",
+// ".yml", ".toml", or else JSON. A file in FBP notation defines a single
+// circuit, named after the file.
+func parseDefinitions(filename string, data []byte) (map[string]*definition, []importDef, error) {
+	ext := filepath.Ext(filename)
+	switch strings.ToLower(ext) {
+	case ".fbp":
+		name := strings.TrimSuffix(filepath.Base(filename), ext)
+		return map[string]*definition{name: fbpDefinition(filename, data)}, nil, nil
+	case ".yaml", ".yml":
+		return yamlDefinitions(filename, data)
+	case ".toml":
+		return tomlDefinitions(filename, data)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, jsonError(filename, data, 0, err)
+	}
+	// decode again, to find out where each definition starts
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.Token() // the opening brace, it's valid JSON by now
+	var imports []importDef
+	defs := map[string]*definition{}
+	for dec.More() {
+		key, _ := dec.Token()
+		name := key.(string)
+		var def json.RawMessage
+		dec.Decode(&def)
+		// line numbers are relative to the start of each definition
+		start := int(dec.InputOffset()) - len(def)
+		base := bytes.Count(data[:start], []byte("\n"))
+		if name == "import" {
+			var v interface{}
+			err := json.Unmarshal(def, &v)
+			if err == nil {
+				imports, err = importDefs(v)
+			}
+			if err != nil {
+				return nil, nil, &DefinitionError{File: filename, Line: base + 1,
+					Path: "import", Msg: err.Error()}
+			}
+			continue
 		}
-		for _, f := range conf.Feeds {
-			if f.Tag != "" {
-				c.Feed(f.To, Tag{f.Tag, f.Data})
-			} else {
-				c.Feed(f.To, f.Data)
+		defs[name] = jsonDefinition(filename, def, base)
+	}
+	return defs, imports, nil
+}
+
+func jsonDefinition(filename string, data []byte, base int) *definition {
+	return &definition{
+		file: filename,
+		decode: func() (*config, error) {
+			var conf config
+			if err := json.Unmarshal(data, &conf); err != nil {
+				return nil, jsonError(filename, data, base, err)
 			}
+			return &conf, nil
+		},
+		asJSON: func() ([]byte, error) { return data, nil },
+		lines:  jsonLines(data, base),
+	}
+}
+
+// Add the line number to JSON errors which report an offset.
+func jsonError(filename string, data []byte, base int, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := base + 1 + bytes.Count(data[:offset], []byte("\n"))
+	return &DefinitionError{File: filename, Line: line, Msg: err.Error()}
+}
+
+// Find the line on which each object and array element starts in valid JSON.
+func jsonLines(data []byte, base int) map[string]int {
+	lines := map[string]int{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		pos := int(dec.InputOffset())
+		for pos < len(data) && strings.IndexByte(" \t\r\n,:", data[pos]) >= 0 {
+			pos++
+		}
+		lines[path] = base + 1 + bytes.Count(data[:pos], []byte("\n"))
+		tok, err := dec.Token()
+		if err != nil {
+			return err
 		}
-		for _, l := range conf.Labels {
-			c.Label(l.External, l.Internal)
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				sub := strings.ToLower(key.(string))
+				if path != "" {
+					sub = path + "." + sub
+				}
+				if err := walk(sub); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
 		}
+		return err
 	}
-	return err
+	walk("")
+	return lines
 }
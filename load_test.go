@@ -0,0 +1,217 @@
+package flow_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func TestDescribeRoundTrip(t *testing.T) {
+	sub := flow.NewCircuit()
+	sub.Add("r", "Repeater")
+	sub.Feed("r.Num", 2)
+	sub.Label("In", "r.In")
+	sub.Label("Out", "r.Out")
+
+	g := flow.NewCircuit()
+	g.Add("p", "Pipe")
+	g.AddPool("q", "Pipe", 3, true)
+	g.AddCircuitry("sub", sub)
+	g.Add("c", "Counter")
+	g.Connect("p.Out", "q.In", 5)
+	g.Connect("q.Out", "sub.In", 0)
+	g.Connect("sub.Out", "c.In", 2)
+	g.Feed("p.In", "abc")
+	g.Feed("p.In", flow.Tag{"tag", 123})
+	g.Label("In", "p.In")
+	g.Label("Count", "c.Out")
+
+	data, err := json.Marshal(g.Describe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"circuit":`, `"capacity":5`, `"replicas":3`,
+		`{"external":"Count","internal":"c.Out"}`, `"tag":"tag"`} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("missing %s in description: %s", s, data)
+		}
+	}
+
+	g2 := flow.NewCircuit()
+	if err := g2.LoadJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	data2, err := json.Marshal(g2.Describe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(data2) {
+		t.Errorf("round trip mismatch:\n%s\n%s", data, data2)
+	}
+}
+
+func TestDescribeUnregistered(t *testing.T) {
+	g := flow.NewCircuit()
+	g.AddCircuitry("t", flow.Transformer(func(m flow.Message) flow.Message {
+		return m
+	}))
+	data, _ := json.Marshal(g.Describe())
+	if string(data) != `{"unregistered":["t"]}` {
+		t.Errorf("unexpected description: %s", data)
+	}
+}
+
+func ExampleCircuit_LoadYAML() {
+	g := flow.NewCircuit()
+	err := g.LoadYAML([]byte(`
+# print whatever comes out of the pipe
+gadgets:
+  - { name: p, type: Pipe }
+  - { name: out, type: Printer }
+wires:
+  - { from: p.Out, to: out.In }
+feeds:
+  - { data: hello, to: p.In }
+`))
+	flow.Check(err)
+	g.Run()
+	// Output:
+	// hello
+}
+
+func ExampleCircuit_LoadTOML() {
+	g := flow.NewCircuit()
+	err := g.LoadTOML([]byte(`
+# print whatever comes out of the pipe
+[[gadgets]]
+name = "p"
+type = "Pipe"
+
+[[gadgets]]
+name = "out"
+type = "Printer"
+
+[[wires]]
+from = "p.Out"
+to = "out.In"
+
+[[feeds]]
+data = "hello"
+to = "p.In"
+`))
+	flow.Check(err)
+	g.Run()
+	// Output:
+	// hello
+}
+
+func TestLoadErrorLines(t *testing.T) {
+	tests := []struct {
+		load func(*flow.Circuit, []byte) error
+		data string
+		want string
+	}{
+		{(*flow.Circuit).LoadJSON, `{
+			"gadgets": [
+				{ "name": "p", "type": "Pipe" },
+				{ "name": "q", "type": "Nope" }
+			]
+		}`, "line 4: gadgets[1]: unknown gadget type: Nope"},
+		{(*flow.Circuit).LoadJSON, `{ "wires": [ 1 ] }`, "line 1: json: cannot unmarshal"},
+		{(*flow.Circuit).LoadYAML, `
+gadgets:
+  - name: p
+    type: Pipe
+wires:
+  - from: p.Out
+    to: x.In
+`, "line 6: wires[0]: gadget not found for: x.In"},
+		{(*flow.Circuit).LoadTOML, `
+[[gadgets]]
+name = "p"
+type = "Pipe"
+
+[[gadgets]]
+name = "c"
+
+[gadgets.circuit]
+labels = [ { external = "a.b", internal = "p.In" } ]
+`, "line 9: gadgets[1].circuit.labels[0]: invalid external pin name"},
+	}
+	for i, test := range tests {
+		err := test.load(flow.NewCircuit(), []byte(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%d: expected %q, got: %v", i, test.want, err)
+		}
+	}
+}
+
+func TestAddToRegistryFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer flow.RemoveFromRegistry("jsonDef", "yamlDef", "tomlDef")
+
+	files := map[string]string{
+		"a.json": `{ "jsonDef": { "gadgets": [ { "name": "p", "type": "Pipe" } ] } }`,
+		"b.yaml": "yamlDef:\n  gadgets:\n    - { name: p, type: Pipe }\n",
+		"c.toml": "[[tomlDef.gadgets]]\nname = \"p\"\ntype = \"Pipe\"\n",
+	}
+	for name, text := range files {
+		filename := filepath.Join(dir, name)
+		ioutil.WriteFile(filename, []byte(text), 0644)
+		if err := flow.AddToRegistry(filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"jsonDef", "yamlDef", "tomlDef"} {
+		factory := flow.Registry[name]
+		if factory == nil {
+			t.Errorf("%s not registered", name)
+			continue
+		}
+		data, _ := json.Marshal(factory().(*flow.Circuit).Describe())
+		if string(data) != `{"gadgets":[{"name":"p","type":"Pipe"}]}` {
+			t.Errorf("%s: unexpected definition: %s", name, data)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.yaml")
+	ioutil.WriteFile(bad, []byte("x:\n  gadgets: [\n"), 0644)
+	if err := flow.AddToRegistry(bad); err == nil ||
+		!strings.Contains(err.Error(), "bad.yaml: yaml: line") {
+		t.Errorf("expected YAML syntax error, got: %v", err)
+	}
+}
+
+func TestAddToRegistryLines(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"setup.json": `{
+			"sameA": { "gadgets": [ { "name": "p", "type": "Nope" } ] },
+			"sameB": { "gadgets": [ { "name": "p", "type": "Nope" } ] }
+		}`,
+	})
+	defer os.RemoveAll(dir)
+
+	err := flow.AddToRegistry(filepath.Join(dir, "setup.json"))
+	errs, ok := err.(flow.DefinitionErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", err)
+	}
+	for i, want := range []string{
+		"line 2: sameA.gadgets[0]: unknown gadget type: Nope",
+		"line 3: sameB.gadgets[0]: unknown gadget type: Nope",
+	} {
+		if !strings.HasSuffix(errs[i].Error(), want) {
+			t.Errorf("expected %q, got: %v", want, errs[i])
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Load a circuit from a TOML description, using the same structure as JSON,
+// i.e. with [[gadgets]], [[wires]], [[feeds]], and [[labels]] tables.
+func (c *Circuit) LoadTOML(data []byte) error {
+	return c.loadDefinition(&definition{
+		decode: func() (*config, error) {
+			var conf config
+			if _, err := toml.Decode(string(data), &conf); err != nil {
+				return nil, err
+			}
+			return &conf, nil
+		},
+		lines: tomlLines(data, ""),
+	})
+}
+
+// Parse a TOML file with named circuit definitions, see AddToRegistry. Each
+// definition is a table, e.g. [[main.gadgets]] adds a gadget to "main".
+func tomlDefinitions(filename string, data []byte) (map[string]*definition, []importDef, error) {
+	var raw map[string]toml.Primitive
+	md, err := toml.Decode(string(data), &raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	var imports []importDef
+	if prim, ok := raw["import"]; ok {
+		var v interface{}
+		err := md.PrimitiveDecode(prim, &v)
+		if err == nil {
+			imports, err = importDefs(v)
+		}
+		if err != nil {
+			return nil, nil, &DefinitionError{File: filename, Path: "import", Msg: err.Error()}
+		}
+		delete(raw, "import")
+	}
+	var mutex sync.Mutex // decoding primitives is not re-entrant
+	defs := map[string]*definition{}
+	for name, prim := range raw {
+		prim := prim
+		defs[name] = &definition{
+			file: filename,
+			decode: func() (*config, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				var conf config
+				if err := md.PrimitiveDecode(prim, &conf); err != nil {
+					return nil, fmt.Errorf("%s: %v", filename, err)
+				}
+				return &conf, nil
+			},
+			asJSON: func() ([]byte, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				var v interface{}
+				if err := md.PrimitiveDecode(prim, &v); err != nil {
+					return nil, fmt.Errorf("%s: %v", filename, err)
+				}
+				return json.Marshal(v)
+			},
+			lines: tomlLines(data, name),
+		}
+	}
+	return defs, imports, nil
+}
+
+// Find the line of each table header, and use it as the line of that entry.
+// Entries defined as inline tables are not found here.
+func tomlLines(data []byte, prefix string) map[string]int {
+	lines := map[string]int{}
+	counts := map[string]int{} // number of entries seen per array of tables
+	resolve := func(parts []string) string {
+		path := ""
+		for i, part := range parts {
+			if i > 0 {
+				path += "."
+			}
+			path += strings.ToLower(strings.TrimSpace(part))
+			if n, ok := counts[path]; ok && i < len(parts)-1 {
+				path += fmt.Sprintf("[%d]", n-1) // refers to the latest entry
+			}
+		}
+		return path
+	}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		s := strings.TrimSpace(string(line))
+		array := strings.HasPrefix(s, "[[")
+		if !strings.HasPrefix(s, "[") || strings.IndexByte(s, ']') < 0 {
+			continue
+		}
+		name := strings.Trim(s[:strings.IndexByte(s, ']')], "[ ")
+		if prefix != "" {
+			if !strings.HasPrefix(name, prefix+".") {
+				continue
+			}
+			name = name[len(prefix)+1:]
+		}
+		path := resolve(strings.Split(name, "."))
+		if array {
+			n := counts[path]
+			counts[path] = n + 1
+			path = fmt.Sprintf("%s[%d]", path, n)
+		}
+		lines[path] = i + 1
+	}
+	return lines
+}
@@ -0,0 +1,106 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load a circuit from a YAML description, using the same structure as JSON.
+func (c *Circuit) LoadYAML(data []byte) error {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return yamlError("", err)
+	}
+	if node.Kind == yaml.DocumentNode {
+		return c.loadDefinition(yamlDefinition("", node.Content[0]))
+	}
+	return nil // empty document
+}
+
+// Parse a YAML file with named circuit definitions, see AddToRegistry.
+func yamlDefinitions(filename string, data []byte) (map[string]*definition, []importDef, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, nil, yamlError(filename, err)
+	}
+	defs := map[string]*definition{}
+	if node.Kind != yaml.DocumentNode {
+		return defs, nil, nil // empty document
+	}
+	top := node.Content[0]
+	if top.Kind != yaml.MappingNode {
+		return nil, nil, &DefinitionError{File: filename, Line: top.Line,
+			Msg: "expected circuit names with their definitions"}
+	}
+	var imports []importDef
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		name, value := top.Content[i].Value, top.Content[i+1]
+		if name == "import" {
+			var v interface{}
+			err := value.Decode(&v)
+			if err == nil {
+				imports, err = importDefs(v)
+			}
+			if err != nil {
+				return nil, nil, &DefinitionError{File: filename, Line: value.Line,
+					Path: "import", Msg: err.Error()}
+			}
+			continue
+		}
+		defs[name] = yamlDefinition(filename, value)
+	}
+	return defs, imports, nil
+}
+
+func yamlDefinition(filename string, node *yaml.Node) *definition {
+	lines := map[string]int{}
+	yamlLines(node, "", lines)
+	return &definition{
+		file: filename,
+		decode: func() (*config, error) {
+			var conf config
+			if err := node.Decode(&conf); err != nil {
+				return nil, yamlError(filename, err)
+			}
+			return &conf, nil
+		},
+		asJSON: func() ([]byte, error) {
+			var v interface{}
+			if err := node.Decode(&v); err != nil {
+				return nil, yamlError(filename, err)
+			}
+			return json.Marshal(v)
+		},
+		lines: lines,
+	}
+}
+
+// The YAML package already reports line numbers, just add the file name.
+func yamlError(filename string, err error) error {
+	if filename == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %v", filename, err)
+}
+
+// Collect the line on which each mapping and sequence entry starts.
+func yamlLines(node *yaml.Node, path string, lines map[string]int) {
+	lines[path] = node.Line
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			sub := strings.ToLower(node.Content[i].Value)
+			if path != "" {
+				sub = path + "." + sub
+			}
+			yamlLines(node.Content[i+1], sub, lines)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			yamlLines(item, fmt.Sprintf("%s[%d]", path, i), lines)
+		}
+	}
+}
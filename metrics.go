@@ -0,0 +1,110 @@
+package flow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// The metrics which are exported, in the order in which they are written.
+var metricFamilies = []struct{ name, typ, help string }{
+	{"flow_messages_in_total", "counter", "Messages sent to an input pin."},
+	{"flow_messages_out_total", "counter", "Messages sent from an output pin."},
+	{"flow_queue_depth", "gauge", "Messages waiting to be received on an input pin."},
+	{"flow_queue_capacity", "gauge", "Buffer size of the wire to an input pin."},
+	{"flow_send_timeouts_total", "counter", "Sends to an input pin which timed out."},
+	{"flow_rate_limited_total", "counter", "Sends held up by the rate limit of an input pin."},
+	{"flow_rate_dropped_total", "counter", "Messages dropped by the rate limit of an input pin."},
+	{"flow_lost_messages_total", "counter", "Messages sent from an output pin which is not connected."},
+	{"flow_panics_total", "counter", "Panics in a gadget."},
+	{"flow_dispatcher_gadgets", "gauge", "Gadgets created by a dispatcher."},
+}
+
+// WriteMetrics writes the counters and gauges of this circuit and all its
+// sub-circuits in the Prometheus text format. Each sample has a "circuit"
+// label with the path of the circuit, a "gadget" label, and a "pin" label
+// where applicable.
+func (c *Circuit) WriteMetrics(w io.Writer) error {
+	samples := map[string][]string{}
+	add := func(family string, info *gadgetInfo, pin string, value uint64) {
+		labels := fmt.Sprintf(`circuit="%s",gadget="%s"`,
+			labelValue(info.circuit), labelValue(info.name))
+		if pin != "" {
+			labels += fmt.Sprintf(`,pin="%s"`, labelValue(pin))
+		}
+		samples[family] = append(samples[family],
+			fmt.Sprintf("%s{%s} %d", family, labels, value))
+	}
+	c.eachGadget("", func(info *gadgetInfo) {
+		for _, in := range info.inputs {
+			w := in.wire
+			add("flow_messages_in_total", info, in.pin, atomic.LoadUint64(&w.sent))
+			add("flow_queue_depth", info, in.pin, uint64(len(w.channel)))
+			add("flow_queue_capacity", info, in.pin, uint64(w.capacity))
+			add("flow_send_timeouts_total", info, in.pin, atomic.LoadUint64(&w.timeouts))
+			if w.rateLimiter() != nil {
+				add("flow_rate_limited_total", info, in.pin, atomic.LoadUint64(&w.limited))
+				add("flow_rate_dropped_total", info, in.pin, atomic.LoadUint64(&w.dropped))
+			}
+		}
+		for _, out := range info.outputs {
+			o := out.out
+			add("flow_messages_out_total", info, out.pin, atomic.LoadUint64(&o.sent))
+			add("flow_lost_messages_total", info, out.pin, atomic.LoadUint64(&o.lost))
+		}
+		add("flow_panics_total", info, "", uint64(atomic.LoadUint32(&info.gadget.panics)))
+		if sub, ok := info.gadget.circuitry.(*Circuit); ok && sub.isDispatcher() {
+			sub.mu.Lock()
+			n := len(sub.gadgets) - 2 // not counting the head and tail
+			sub.mu.Unlock()
+			add("flow_dispatcher_gadgets", info, "", uint64(n))
+		}
+	})
+
+	out := bufio.NewWriter(w)
+	for _, f := range metricFamilies {
+		if len(samples[f.name]) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range samples[f.name] {
+			fmt.Fprintln(out, s)
+		}
+	}
+	return out.Flush()
+}
+
+// MetricsHandler returns an HTTP handler which serves the metrics of this
+// circuit, for use by Prometheus. It is also available as "/metrics" in the
+// AdminHandler.
+func (c *Circuit) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.WriteMetrics(w)
+	})
+}
+
+// Return true if this circuit was created as "Dispatcher", or as
+// "PacketMapDispatcher".
+func (c *Circuit) isDispatcher() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	head := c.gadgets["head"]
+	if head == nil {
+		return false
+	}
+	switch head.circuitry.(type) {
+	case *dispatchHead, *pmDispatchHead:
+		return true
+	}
+	return false
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,69 @@
+package flow_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+type panicky struct {
+	flow.Gadget
+}
+
+func (g *panicky) Run() {
+	panic("oops")
+}
+
+func TestWriteMetrics(t *testing.T) {
+	sub := flow.NewCircuit()
+	sub.Add("r", "Repeater")
+	sub.Add("c", "Counter")
+	sub.Connect("r.Out", "c.In", 2)
+	sub.Feed("r.Num", 3)
+	sub.Feed("r.In", "abc")
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("sub", sub)
+	g.Add("d", "Dispatcher")
+	g.Feed("d.In", flow.Tag{"<dispatch>", "Counter"})
+	g.Feed("d.In", "abc")
+	g.Add("pm", "PacketMapDispatcher")
+	g.Feed("pm.Field", "key")
+	g.Feed("pm.In", flow.PacketMap{"key": "Counter"})
+	g.Feed("pm.In", flow.PacketMap{"key": "Counter"})
+	g.Run()
+
+	var buf bytes.Buffer
+	flow.Check(g.WriteMetrics(&buf))
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE flow_messages_in_total counter",
+		`flow_messages_in_total{circuit="sub",gadget="c",pin="In"} 3`,
+		`flow_messages_out_total{circuit="sub",gadget="r",pin="Out"} 3`,
+		`flow_queue_capacity{circuit="sub",gadget="c",pin="In"} 2`,
+		`flow_lost_messages_total{circuit="sub",gadget="c",pin="Out"} 1`,
+		`flow_send_timeouts_total{circuit="sub",gadget="c",pin="In"} 0`,
+		`flow_panics_total{circuit="",gadget="sub"} 0`,
+		`flow_dispatcher_gadgets{circuit="",gadget="d"} 1`,
+		`flow_dispatcher_gadgets{circuit="",gadget="pm"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestPanicMetrics(t *testing.T) {
+	g := flow.NewCircuit()
+	g.AddCircuitry("p", new(panicky))
+	g.Run()
+
+	var buf bytes.Buffer
+	flow.Check(g.WriteMetrics(&buf))
+	if !strings.Contains(buf.String(), `flow_panics_total{circuit="",gadget="p"} 1`) {
+		t.Errorf("panic not counted:\n%s", buf.String())
+	}
+}
@@ -146,7 +146,10 @@ func init() {
 		c.Label("In", "head.In")
 		c.Label("Prefix", "head.Prefix")
 		c.Label("Field", "head.Field")
+		c.Label("MaxIdle", "head.MaxIdle")
+		c.Label("MaxGadgets", "head.MaxGadgets")
 		c.Label("Rej", "head.Rej")
+		c.Label("Evicted", "head.Evicted")
 		c.Label("Out", "tail.Out")
 		return c
 	}
@@ -154,15 +157,21 @@ func init() {
 
 // Dispatch to a gadget based on a field in incoming PacketMaps
 // Registers as "PacketMapDispatcher".
+//
+// As with the Dispatcher, MaxIdle and MaxGadgets limit how long and how many
+// gadgets are kept around, the keys of evicted ones are sent to Evicted.
 type PacketMapDispatcher Circuit
 
 type pmDispatchHead struct {
 	Gadget
-	Prefix Input             // Expects string with decoder gadget prefix
-	Field  Input             // Expects string with field to dispatch on
-	In     Input             // Expects PacketMaps with [field]:string
-	Rej    Output            // Outputs rejected gadget names
-	Feeds  map[string]Output // Output leading to all the decoders
+	Prefix     Input             // Expects string with decoder gadget prefix
+	Field      Input             // Expects string with field to dispatch on
+	MaxIdle    Input             // Expects duration after which to evict decoders
+	MaxGadgets Input             // Expects max number of decoders to keep
+	In         Input             // Expects PacketMaps with [field]:string
+	Rej        Output            // Outputs rejected gadget names
+	Evicted    Output            // Outputs <evicted> tags with the keys
+	Feeds      map[string]Output // Output leading to all the decoders
 }
 
 type pmDispatchTail struct {
@@ -193,16 +202,34 @@ func (g *pmDispatchHead) Run() {
 		glog.Warningf("No field to dispatch on specified")
 	}
 	glog.Infof("PacketMapDispatch on field '%s' with prefix '%s'", field, prefix)
+	limits := readLimits(g.MaxIdle, g.MaxGadgets)
+	tick, stop := limits.ticker()
+	defer stop()
 
-	for m := range g.In {
+	for {
+		var m Message
+		select {
+		case msg, ok := <-g.In:
+			if !ok {
+				return
+			}
+			m = msg
+		case <-tick:
+			g.evict(prefix, limits.victims("", false))
+			continue
+		}
 		glog.V(4).Infof("In: %+v", m)
 		glog.V(6).Infof("Feeds: %+v", g.Feeds)
 		if v, ok := m.(PacketMap); ok {
 			if gadget := v.String(field); gadget != "" {
 				if _, ok := g.Feeds[gadget]; !ok {
+					if Registry[prefix+gadget] != nil {
+						g.evict(prefix, limits.victims("", true))
+					}
 					g.addGadget(prefix, gadget)
 				}
 				if feed, ok := g.Feeds[gadget]; ok && feed != nil {
+					limits.touch(gadget)
 					glog.V(1).Infof("Dispatch to %s", gadget)
 					glog.V(4).Infof("Feed: %+v", m)
 					v["decoder"] = gadget
@@ -225,11 +252,21 @@ func (g *pmDispatchHead) addGadget(prefix, key string) {
 	} else { // create, hook up, and launch the new gadget
 		glog.Infof("hooking up %s for dispatch", pm)
 		c := g.Owner()
+		c.mu.Lock() // the circuit may be launching or evicting gadgets
 		c.Add(pm, pm)
 		c.Connect("head.Feeds:"+key, pm+".In", 0)
 		c.Connect(pm+".Out", "tail.In", 0)
+		c.mu.Unlock()
 		c.RunGadget(pm)
 		//glog.V(4).Infoln(self+".Feeds:"+key, "->", pm+".In")
 		//glog.V(4).Infoln(pm+".Out", "->", dest)
 	}
 }
+
+// Evict decoders, given their dispatch keys.
+func (g *pmDispatchHead) evict(prefix string, keys []string) {
+	for _, key := range keys {
+		g.evictDispatched(g.Feeds, key, prefix+key)
+		g.Evicted.Send(Tag{"<evicted>", key})
+	}
+}
@@ -0,0 +1,229 @@
+package flow
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Circuit definitions added by AddToRegistry, these can be given parameters.
+var definitions = map[string]*definition{}
+
+// SetParams supplies values for placeholders such as "${APP_DIR}" in the
+// definitions which are subsequently loaded into this circuit. Placeholders
+// which are not given a value here are looked up in Configuration and Config,
+// then in the environment, and then in the "params" section of the definition,
+// which lists default values. A placeholder can also specify its own default,
+// as in "${PORT:-8080}". Use "$$" for a literal dollar sign.
+func (c *Circuit) SetParams(params map[string]string) {
+	c.params = params
+}
+
+// Add a circuit which was defined in a setup file, with values for the
+// parameters in its definition. Returns an error if the type is not found, or
+// if a parameter of the definition has no value.
+func (c *Circuit) AddWithParams(name, gadget string, params map[string]string) error {
+	def := definitions[gadget]
+	if def == nil {
+		return fmt.Errorf("not found: %s", gadget)
+	}
+	if err := checkParams(def, params); err != nil {
+		return fmt.Errorf("%s: %v", gadget, err)
+	}
+	c.gnames = append(c.gnames, gadgetDef{Name: name, Type: gadget, Params: params})
+	c.AddCircuitry(name, newWithParams(def, params))
+	return nil
+}
+
+// Create a circuit from a definition. Its parameters have been checked when it
+// was loaded, so errors are only logged here.
+func newWithParams(def *definition, params map[string]string) *Circuit {
+	g := NewCircuit()
+	g.SetParams(params)
+	if err := g.loadDefinition(def); err != nil {
+		glog.Errorln(err)
+	}
+	return g
+}
+
+// Check that all placeholders in a definition get a value with these params.
+func checkParams(def *definition, params map[string]string) error {
+	conf, err := def.decode()
+	if err != nil {
+		return err
+	}
+	r := newParamResolver(params, conf.Params)
+	r.config(conf, "")
+	if len(r.errs) > 0 {
+		return r.errs
+	}
+	return nil
+}
+
+var paramRef = regexp.MustCompile(`\$\$|\$\{([A-Za-z_]\w*)(:-([^}]*))?\}`)
+
+// A paramResolver replaces all placeholders in a definition.
+type paramResolver struct {
+	explicit map[string]string // set by the caller
+	defaults map[string]string // from the definition
+	lenient  bool              // leave unknown placeholders alone
+	errs     DefinitionErrors
+}
+
+func newParamResolver(explicit, defaults map[string]string) *paramResolver {
+	return &paramResolver{explicit: explicit, defaults: defaults}
+}
+
+func (r *paramResolver) lookup(name string) (string, bool) {
+	if v, ok := r.explicit[name]; ok {
+		return v, true
+	}
+	if v, ok := Configuration.Get(name); ok {
+		return v, true
+	}
+	if v, ok := Config[name]; ok {
+		return v, true
+	}
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true
+	}
+	v, ok := r.defaults[name]
+	return v, ok
+}
+
+// Expand all the placeholders in a string.
+func (r *paramResolver) expand(path, s string) string {
+	return paramRef.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		m := paramRef.FindStringSubmatch(ref)
+		if v, ok := r.lookup(m[1]); ok {
+			return v
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		if r.lenient {
+			return ref
+		}
+		r.errs = append(r.errs, &DefinitionError{
+			Path: path,
+			Msg:  "undefined parameter: " + m[1],
+		})
+		return ""
+	})
+}
+
+// Expand the placeholders in all strings inside a message.
+func (r *paramResolver) message(path string, m Message) Message {
+	switch v := m.(type) {
+	case string:
+		return r.expand(path, v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = r.message(fmt.Sprintf("%s[%d]", path, i), e)
+		}
+		return out
+	case map[string]interface{}:
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := map[string]interface{}{}
+		for _, k := range keys {
+			out[k] = r.message(path+"."+k, v[k])
+		}
+		return out
+	}
+	return m
+}
+
+// Return a copy of a definition with all placeholders expanded.
+func (r *paramResolver) config(conf *config, prefix string) *config {
+	out := &config{Unregistered: conf.Unregistered}
+	for i, g := range conf.Gadgets {
+		path := fmt.Sprintf("%sgadgets[%d]", prefix, i)
+		g.Type = r.expand(path+".type", g.Type)
+		if g.Params != nil {
+			params := map[string]string{}
+			for _, k := range sortedKeys(g.Params) {
+				params[k] = r.expand(path+".params."+k, g.Params[k])
+			}
+			g.Params = params
+		}
+		if def := definitions[g.Type]; def != nil && !r.lenient {
+			// catch missing parameters now, not when the circuit is created
+			if err := checkParams(def, g.Params); err != nil {
+				r.errs = append(r.errs, &DefinitionError{
+					Path: path,
+					Msg:  g.Type + ": " + err.Error(),
+				})
+			}
+		}
+		if g.Circuit != nil {
+			// inline circuits see the same parameters, plus their own
+			sub := newParamResolver(merge(r.explicit, g.Params),
+				merge(r.defaults, g.Circuit.Params))
+			sub.lenient = r.lenient
+			g.Circuit = sub.config(g.Circuit, path+".circuit.")
+			r.errs = append(r.errs, sub.errs...)
+		}
+		out.Gadgets = append(out.Gadgets, g)
+	}
+	for i, w := range conf.Wires {
+		path := fmt.Sprintf("%swires[%d]", prefix, i)
+		w.From = r.expand(path+".from", w.From)
+		w.To = r.expand(path+".to", w.To)
+		w.Durable = r.expand(path+".durable", w.Durable)
+		out.Wires = append(out.Wires, w)
+	}
+	for i, f := range conf.Feeds {
+		path := fmt.Sprintf("%sfeeds[%d]", prefix, i)
+		f.Tag = r.expand(path+".tag", f.Tag)
+		f.Data = r.message(path+".data", f.Data)
+		f.To = r.expand(path+".to", f.To)
+		f.After = r.expand(path+".after", f.After)
+		f.At = r.expand(path+".at", f.At)
+		f.Every = r.expand(path+".every", f.Every)
+		out.Feeds = append(out.Feeds, f)
+	}
+	for i, l := range conf.Labels {
+		path := fmt.Sprintf("%slabels[%d]", prefix, i)
+		l.Internal = r.expand(path+".internal", l.Internal)
+		out.Labels = append(out.Labels, l)
+	}
+	return out
+}
+
+// Return the union of two maps, with entries from b taking precedence.
+func merge(a, b map[string]string) map[string]string {
+	m := map[string]string{}
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
+
+// Return true if a string still contains a placeholder.
+func hasParam(s string) bool {
+	return strings.Contains(s, "${")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
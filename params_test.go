@@ -0,0 +1,155 @@
+package flow_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func ExampleCircuit_SetParams() {
+	flow.Config["APP_DIR"] = "/app"
+	defer delete(flow.Config, "APP_DIR")
+
+	g := flow.NewCircuit()
+	g.SetParams(map[string]string{"NAME": "data"})
+	err := g.LoadJSON([]byte(`{
+		"gadgets": [ { "name": "p", "type": "Printer" } ],
+		"feeds": [
+			{ "data": "${APP_DIR}/${NAME}.json", "to": "p.In" },
+			{ "data": "${PORT:-8080} costs $$5", "to": "p.In" }
+		]
+	}`))
+	flow.Check(err)
+	g.Run()
+	// Output:
+	// /app/data.json
+	// 8080 costs $5
+}
+
+func TestParamSources(t *testing.T) {
+	os.Setenv("FLOW_TEST_ENV", "env")
+	defer os.Unsetenv("FLOW_TEST_ENV")
+
+	g := flow.NewCircuit()
+	err := g.LoadJSON([]byte(`{
+		"params": { "A": "default", "FLOW_TEST_ENV": "default" },
+		"gadgets": [ { "name": "p", "type": "Pipe" } ],
+		"feeds": [
+			{ "data": { "a": "${A}", "b": [ "${FLOW_TEST_ENV}" ] }, "to": "p.In" }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(g.Describe())
+	if !strings.Contains(string(data), `"data":{"a":"default","b":["env"]}`) {
+		t.Errorf("unexpected description: %s", data)
+	}
+
+	err = flow.NewCircuit().LoadJSON([]byte(`{
+		"gadgets": [ { "name": "p", "type": "Pipe" } ],
+		"feeds": [
+			{ "data": "${NOPE}", "to": "p.In" }
+		]
+	}`))
+	if err == nil || !strings.Contains(err.Error(),
+		"line 4: feeds[0].data: undefined parameter: NOPE") {
+		t.Errorf("expected undefined parameter error, got: %v", err)
+	}
+}
+
+func TestAddWithParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "setup.json")
+	ioutil.WriteFile(filename, []byte(`{
+		"greeter": {
+			"params": { "WHO": "world" },
+			"gadgets": [ { "name": "p", "type": "Pipe" } ],
+			"feeds": [ { "data": "hello ${WHO}", "to": "p.In" } ],
+			"labels": [ { "external": "Out", "internal": "p.Out" } ]
+		}
+	}`), 0644)
+	if err := flow.AddToRegistry(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer flow.RemoveFromRegistry("greeter")
+
+	g := flow.NewCircuit()
+	err = g.LoadJSON([]byte(`{
+		"gadgets": [
+			{ "name": "a", "type": "greeter" },
+			{ "name": "b", "type": "greeter", "params": { "WHO": "there" } },
+			{ "name": "c1", "type": "Printer" },
+			{ "name": "c2", "type": "Printer" }
+		],
+		"wires": [
+			{ "from": "a.Out", "to": "c1.In" },
+			{ "from": "b.Out", "to": "c2.In" }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(g.Describe())
+	if !strings.Contains(string(data), `{"name":"b","type":"greeter","params":{"WHO":"there"}}`) {
+		t.Errorf("params missing from description: %s", data)
+	}
+
+	err = flow.NewCircuit().LoadJSON([]byte(`{
+		"gadgets": [ { "name": "c", "type": "Pipe", "params": { "WHO": "nobody" } } ]
+	}`))
+	if err == nil || !strings.Contains(err.Error(), "does not take parameters") {
+		t.Errorf("expected parameter error, got: %v", err)
+	}
+}
+
+func TestAddWithParamsUndefined(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "setup.json")
+	ioutil.WriteFile(filename, []byte(`{
+		"needy": {
+			"gadgets": [ { "name": "p", "type": "Pipe" } ],
+			"feeds": [ { "data": "${FLOW_TEST_UNSET}", "to": "p.In" } ]
+		}
+	}`), 0644)
+	if err := flow.AddToRegistry(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer flow.RemoveFromRegistry("needy")
+
+	g := flow.NewCircuit()
+	err = g.AddWithParams("a", "needy", map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "undefined parameter: FLOW_TEST_UNSET") {
+		t.Errorf("expected undefined parameter error, got: %v", err)
+	}
+	if err := g.AddWithParams("b", "needy", map[string]string{"FLOW_TEST_UNSET": "x"}); err != nil {
+		t.Error(err)
+	}
+	if err := g.AddWithParams("c", "nosuch", nil); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+
+	err = flow.NewCircuit().LoadJSON([]byte(`{
+		"gadgets": [ { "name": "a", "type": "needy", "params": { "OTHER": "1" } } ]
+	}`))
+	if err == nil || !strings.Contains(err.Error(),
+		"line 2: gadgets[0]: needy: feeds[0].data: undefined parameter: FLOW_TEST_UNSET") {
+		t.Errorf("expected undefined parameter error, got: %v", err)
+	}
+}
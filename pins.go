@@ -0,0 +1,137 @@
+package flow
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A PinInfo describes one pin of a gadget type, as returned by Pins. The
+// direction is "in" or "out", or empty if it can't be determined, e.g. when
+// a circuit refers to a gadget type which depends on a parameter.
+type PinInfo struct {
+	Name string `json:"name"`
+	Dir  string `json:"dir,omitempty"`
+}
+
+// Types returns the names of all gadget types in the registry, sorted.
+func Types() []string {
+	return registryNames()
+}
+
+// Pins returns the pins of a registered gadget type, sorted by name. For
+// circuits defined in a setup file, these are the external pins, which get
+// their direction from the internal pins they are labeled to.
+func Pins(typ string) ([]PinInfo, error) {
+	return typePinInfo(typ, 0)
+}
+
+func typePinInfo(typ string, depth int) ([]PinInfo, error) {
+	if Registry[typ] == nil {
+		return nil, fmt.Errorf("unknown gadget type: %s", typ)
+	}
+	if def := definitions[typ]; def != nil {
+		conf, err := def.decode()
+		if err != nil {
+			return nil, err
+		}
+		return configPins(conf, depth), nil
+	}
+	pins, _ := goTypePins(typ)
+	return pins, nil
+}
+
+// The pins of each gadget type implemented in Go are cached, so that checking
+// definitions does not create throwaway gadgets all the time. The factory is
+// kept to notice when a type is registered again.
+var pinCache = struct {
+	sync.Mutex
+	types map[string]cachedPins
+}{types: map[string]cachedPins{}}
+
+type cachedPins struct {
+	factory uintptr
+	pins    []PinInfo
+}
+
+// Return the pins of a gadget type implemented in Go. If they are not known
+// yet, an instance has to be created, which is then returned as well.
+func goTypePins(typ string) ([]PinInfo, Circuitry) {
+	factory := reflect.ValueOf(Registry[typ]).Pointer()
+	pinCache.Lock()
+	cached, ok := pinCache.types[typ]
+	pinCache.Unlock()
+	if ok && cached.factory == factory {
+		return cached.pins, nil
+	}
+	g := Registry[typ]()
+	pins := circuitryPins(g)
+	pinCache.Lock()
+	pinCache.types[typ] = cachedPins{factory, pins}
+	pinCache.Unlock()
+	return pins, g
+}
+
+// Return the external pins of a circuit definition, looking up the direction
+// of the internal pins. The depth avoids endless recursion in bad definitions.
+func configPins(conf *config, depth int) []PinInfo {
+	gadgets := map[string]gadgetDef{}
+	for _, g := range conf.Gadgets {
+		gadgets[g.Name] = g
+	}
+	pins := []PinInfo{}
+	for _, l := range conf.Labels {
+		info := PinInfo{Name: l.External}
+		if g, ok := gadgets[strings.SplitN(l.Internal, ".", 2)[0]]; ok && depth < 10 {
+			var inner []PinInfo
+			switch {
+			case g.Circuit != nil:
+				inner = configPins(g.Circuit, depth+1)
+			case !hasParam(g.Type) && Registry[g.Type] != nil:
+				inner, _ = typePinInfo(g.Type, depth+1)
+			}
+			pin := strings.SplitN(pinPart(l.Internal), ":", 2)[0]
+			for _, p := range inner {
+				if p.Name == pin {
+					info.Dir = p.Dir
+				}
+			}
+		}
+		pins = append(pins, info)
+	}
+	sortPinInfo(pins)
+	return pins
+}
+
+// Return the pins of a gadget or circuit which has been created.
+func circuitryPins(c Circuitry) []PinInfo {
+	pins := []PinInfo{}
+	if cc, ok := c.(*Circuit); ok {
+		for ext, internal := range cc.labels {
+			dir := "out"
+			if cc.isInput(internal) {
+				dir = "in"
+			}
+			pins = append(pins, PinInfo{ext, dir})
+		}
+	} else {
+		v := reflect.ValueOf(c).Elem()
+		for _, name := range pinNames(c) {
+			dir := "out"
+			if v.FieldByName(name).Type().String() == "flow.Input" {
+				dir = "in"
+			}
+			pins = append(pins, PinInfo{name, dir})
+		}
+	}
+	sortPinInfo(pins)
+	return pins
+}
+
+func sortPinInfo(pins []PinInfo) {
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Name < pins[j].Name
+	})
+}
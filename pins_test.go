@@ -0,0 +1,31 @@
+package flow_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func ExamplePins() {
+	dir, _ := ioutil.TempDir("", "flow")
+	defer os.RemoveAll(dir)
+	setup := filepath.Join(dir, "setup.json")
+	ioutil.WriteFile(setup, []byte(`{"counting": {
+		"gadgets": [{ "name": "c", "type": "Counter" }],
+		"labels": [{ "external": "Items", "internal": "c.In" },
+		           { "external": "Total", "internal": "c.Out" }]
+	}}`), 0666)
+	flow.Check(flow.AddToRegistry(setup))
+
+	for _, typ := range []string{"Repeater", "counting"} {
+		pins, _ := flow.Pins(typ)
+		fmt.Println(typ, pins)
+	}
+	// Output:
+	// Repeater [{In in} {Num in} {Out out}]
+	// counting [{Items in} {Total out}]
+}
@@ -0,0 +1,263 @@
+package flow
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// A pool runs several instances of the same gadget type behind a single name.
+// Messages arriving on In are spread across the instances, their Out pins are
+// merged back into one. Other inputs are copied to every instance, and other
+// outputs are merged. The gadget type must have an In and an Out pin, it can
+// also be a circuit, with labels for these pins.
+//
+// In ordered mode, output is emitted in the same order as the input which
+// caused it. This uses markers, so the gadget must pass through any tags it
+// does not recognise, the same requirement as for the Dispatcher.
+func newPool(gadget string, replicas int, ordered bool) *Circuit {
+	constructor := Registry[gadget]
+	if constructor == nil {
+		glog.Warningln("not found:", gadget)
+		return nil
+	}
+	first := constructor() // the pins are taken from the first instance
+	dirs := map[string]string{}
+	for _, p := range circuitryPins(first) {
+		dirs[p.Name] = p.Dir
+	}
+	if dirs["In"] != "in" || dirs["Out"] != "out" {
+		glog.Warningln("cannot pool, needs In and Out pins:", gadget)
+		return nil
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	c := NewCircuit()
+	c.AddCircuitry("head", &poolHead{ordered: ordered})
+	c.AddCircuitry("tail", &poolTail{ordered: ordered, lanes: replicas})
+	c.Label("In", "head.In")
+	c.Label("Out", "tail.Out")
+
+	for i := 0; i < replicas; i++ {
+		w := "w" + strconv.Itoa(i)
+		c.gnames = append(c.gnames, gadgetDef{Name: w, Type: gadget})
+		if i == 0 {
+			c.AddCircuitry(w, first)
+		} else {
+			c.AddCircuitry(w, constructor())
+		}
+		c.Connect("head.Out:"+strconv.Itoa(i), w+".In", 0)
+		if ordered {
+			lane := "lane" + strconv.Itoa(i)
+			c.AddCircuitry(lane, &poolLane{lane: i})
+			c.Connect(w+".Out", lane+".In", 0)
+			c.Connect(lane+".Out", "tail.In", 0)
+		} else {
+			c.Connect(w+".Out", "tail.In", 0)
+		}
+	}
+
+	// replicate all other input pins, and merge all other output pins
+	pins := []string{}
+	for pin := range dirs {
+		pins = append(pins, pin)
+	}
+	sort.Strings(pins)
+	for _, pin := range pins {
+		switch {
+		case pin == "In" || pin == "Out" || isOutputMap(first, pin):
+		case dirs[pin] == "in":
+			c.AddCircuitry("copy"+pin, &poolCopy{})
+			for j := 0; j < replicas; j++ {
+				c.Connect("copy"+pin+".Out:"+strconv.Itoa(j),
+					"w"+strconv.Itoa(j)+"."+pin, 0)
+			}
+			c.Label(pin, "copy"+pin+".In")
+		default:
+			c.AddCircuitry("merge"+pin, &poolMerge{})
+			for j := 0; j < replicas; j++ {
+				c.Connect("w"+strconv.Itoa(j)+"."+pin, "merge"+pin+".In", 0)
+			}
+			c.Label(pin, "merge"+pin+".Out")
+		}
+	}
+	return c
+}
+
+// Return true if a pin of a gadget is a map of outputs, these can't be merged.
+func isOutputMap(g Circuitry, pin string) bool {
+	if _, ok := g.(*Circuit); ok {
+		return false // labels always refer to a single output
+	}
+	return reflect.ValueOf(g).Elem().FieldByName(pin).Kind() == reflect.Map
+}
+
+// AddPool adds a named pool of identical gadgets, which will process messages
+// in parallel. The gadget needs an In and an Out pin. In ordered mode, it must
+// also pass through any tags it does not recognise, see newPool.
+func (c *Circuit) AddPool(name, gadget string, replicas int, ordered bool) {
+	p := newPool(gadget, replicas, ordered)
+	if p == nil {
+		return
+	}
+	c.gnames = append(c.gnames, gadgetDef{
+		Name: name, Type: gadget, Replicas: replicas, Ordered: ordered,
+	})
+	c.AddCircuitry(name, p)
+}
+
+// The head of a pool spreads incoming messages across all instances. When not
+// ordered, it sends to whichever instance is ready to accept a new message.
+type poolHead struct {
+	Gadget
+	In  Input
+	Out map[string]Output
+
+	ordered bool
+}
+
+func (g *poolHead) Run() {
+	n := len(g.Out)
+	outs := make([]*wire, n)
+	for k, o := range g.Out {
+		i, _ := strconv.Atoi(k)
+		outs[i] = o.(*outlet).wire // internal wires, these never move
+	}
+
+	next := 0
+	for m := range g.In {
+		if g.ordered {
+			// strict round-robin, with a marker to delimit the output
+			outs[next].Send(m)
+			outs[next].Send(Tag{"<marker>", g.owner})
+			next = (next + 1) % n
+			continue
+		}
+		if !g.sendAny(outs, next, m) {
+			return // aborted
+		}
+		next = (next + 1) % n
+	}
+}
+
+// Send to the first instance with room for another message, or else wait.
+func (g *poolHead) sendAny(outs []*wire, next int, m Message) bool {
+	for k := range outs {
+		select {
+		case outs[(next+k)%len(outs)].channel <- m:
+			return true
+		default:
+		}
+	}
+	cases := make([]reflect.SelectCase, len(outs)+1)
+	for i, w := range outs {
+		cases[i] = reflect.SelectCase{
+			Dir:  reflect.SelectSend,
+			Chan: reflect.ValueOf(w.channel),
+			Send: reflect.ValueOf(&m).Elem(),
+		}
+	}
+	cases[len(outs)] = reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(g.owner.abort),
+	}
+	chosen, _, _ := reflect.Select(cases)
+	return chosen < len(outs)
+}
+
+// Each lane tags the output of one instance, so that the tail can sort it out.
+type poolLane struct {
+	Gadget
+	In  Input
+	Out Output
+
+	lane int
+}
+
+type poolItem struct {
+	lane int
+	msg  Message
+}
+
+func (g *poolLane) Run() {
+	for m := range g.In {
+		g.Out.Send(poolItem{g.lane, m})
+	}
+}
+
+// The tail of a pool merges all output. In ordered mode, output of each lane
+// is held back until all output of the preceding lanes has been sent out.
+type poolTail struct {
+	Gadget
+	In  Input
+	Out Output
+
+	ordered bool
+	lanes   int
+}
+
+func (g *poolTail) Run() {
+	if !g.ordered {
+		for m := range g.In {
+			g.Out.Send(m)
+		}
+		return
+	}
+
+	pending := make([][]Message, g.lanes)
+	current := 0
+	for m := range g.In {
+		item := m.(poolItem)
+		pending[item.lane] = append(pending[item.lane], item.msg)
+		// send out everything which is now in sequence
+		for len(pending[current]) > 0 {
+			m := pending[current][0]
+			pending[current] = pending[current][1:]
+			if tag, ok := m.(Tag); ok && tag.Tag == "<marker>" && tag.Msg == g.owner {
+				current = (current + 1) % g.lanes
+			} else {
+				g.Out.Send(m)
+			}
+		}
+	}
+	// flush whatever was sent after the last marker, in lane order
+	for i := 0; i < g.lanes; i++ {
+		for _, m := range pending[(current+i)%g.lanes] {
+			if tag, ok := m.(Tag); !ok || tag.Tag != "<marker>" || tag.Msg != g.owner {
+				g.Out.Send(m)
+			}
+		}
+	}
+}
+
+// Copy each incoming message to all instances in the pool.
+type poolCopy struct {
+	Gadget
+	In  Input
+	Out map[string]Output
+}
+
+func (g *poolCopy) Run() {
+	for m := range g.In {
+		for _, o := range g.Out {
+			o.Send(m)
+		}
+	}
+}
+
+// Merge the output of all instances in the pool.
+type poolMerge struct {
+	Gadget
+	In  Input
+	Out Output
+}
+
+func (g *poolMerge) Run() {
+	for m := range g.In {
+		g.Out.Send(m)
+	}
+}
@@ -0,0 +1,94 @@
+package flow_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func ExampleCircuit_AddPool() {
+	g := flow.NewCircuit()
+	g.AddPool("r", "Repeater", 3, true)
+	g.Add("p", "Printer")
+	g.Connect("r.Out", "p.In", 0)
+	g.Feed("r.Num", 2)
+	g.Feed("r.In", "abc")
+	g.Feed("r.In", "def")
+	g.Feed("r.In", "ghi")
+	g.Feed("r.In", "jkl")
+	g.Run()
+	// Output:
+	// abc
+	// abc
+	// def
+	// def
+	// ghi
+	// ghi
+	// jkl
+	// jkl
+}
+
+func ExampleCircuit_AddPool_unordered() {
+	g := flow.NewCircuit()
+	g.AddPool("p", "Pipe", 4, false)
+	g.Add("c", "Counter")
+	g.Add("out", "Printer")
+	g.Connect("p.Out", "c.In", 0)
+	g.Connect("c.Out", "out.In", 0)
+	for i := 0; i < 100; i++ {
+		g.Feed("p.In", i)
+	}
+	g.Run()
+	// Output:
+	// 100
+}
+
+func ExampleCircuit_LoadJSON_replicas() {
+	g := flow.NewCircuit()
+	g.LoadJSON([]byte(`{
+		"gadgets": [
+			{ "name": "p", "type": "Pipe", "replicas": 4, "ordered": true },
+			{ "name": "out", "type": "Printer" }
+		],
+		"wires": [ { "from": "p.Out", "to": "out.In" } ],
+		"feeds": [
+			{ "data": 1, "to": "p.In" },
+			{ "data": 2, "to": "p.In" },
+			{ "data": 3, "to": "p.In" }
+		]
+	}`))
+	g.Run()
+	// Output:
+	// 1
+	// 2
+	// 3
+}
+
+func ExampleCircuit_AddPool_circuit() {
+	dir, _ := ioutil.TempDir("", "flow")
+	defer os.RemoveAll(dir)
+	setup := filepath.Join(dir, "setup.json")
+	ioutil.WriteFile(setup, []byte(`{"relay": {
+		"gadgets": [{ "name": "a", "type": "Pipe" }, { "name": "b", "type": "Pipe" }],
+		"wires": [{ "from": "a.Out", "to": "b.In" }],
+		"labels": [{ "external": "In", "internal": "a.In" },
+		           { "external": "Out", "internal": "b.Out" }]
+	}}`), 0666)
+	flow.Check(flow.AddToRegistry(setup))
+
+	g := flow.NewCircuit()
+	g.AddPool("r", "relay", 2, true)
+	g.Add("p", "Printer")
+	g.Connect("r.Out", "p.In", 0)
+	g.Feed("r.In", "abc")
+	g.Feed("r.In", "def")
+	g.Feed("r.In", "ghi")
+	g.Run()
+	// Output:
+	// abc
+	// def
+	// ghi
+}
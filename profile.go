@@ -0,0 +1,216 @@
+package flow
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// EnableProfiling measures how long each gadget in this circuit and its
+// sub-circuits takes: from receiving a message to its next Send ("process"),
+// how long each Send is blocked ("send"), and how long messages wait in each
+// wire before they are received ("queue"). It must be called before Run, and
+// adds some overhead to every message. Processing times are approximate when
+// a gadget receives a message which was queued while it was busy, since its
+// first Send may then slip in before the message has been recorded.
+// See Profile for the results.
+func (c *Circuit) EnableProfiling() {
+	c.profile = &profile{
+		process:  histograms{},
+		send:     histograms{},
+		queue:    histograms{},
+		received: map[*Gadget]time.Time{},
+	}
+}
+
+// The measurements of a circuit, shared with all its sub-circuits.
+type profile struct {
+	mu       sync.Mutex
+	process  histograms            // by gadget
+	send     histograms            // by gadget
+	queue    histograms            // by wire
+	received map[*Gadget]time.Time // when the last message came in
+}
+
+// A message on a profiled wire carries the time it was sent.
+type timedMessage struct {
+	msg Message
+	at  time.Time
+}
+
+// Prepare all gadgets which have not been launched yet for profiling.
+func (c *Circuit) prepareProfiling() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.gadgets {
+		if g.launched {
+			continue
+		}
+		for _, w := range g.inputs {
+			w.profiled = true
+		}
+		if sub, ok := g.circuitry.(*Circuit); ok {
+			sub.profile = c.profile
+		}
+	}
+}
+
+// Pass messages from a profiled wire to the gadget, to find out when they are
+// picked up. The relay stops when the wire is closed or the gadget is done.
+func (g *Gadget) relay(w *wire) chan Message {
+	p := g.owner.profile
+	out := make(chan Message)
+	go func() {
+		defer close(out)
+		for m := range w.channel {
+			var sent time.Time
+			if t, ok := m.(timedMessage); ok {
+				m, sent = t.msg, t.at
+			}
+			// if the gadget is waiting, hand over the message while locked,
+			// so that the gadget can't send anything before this is recorded
+			p.mu.Lock()
+			select {
+			case out <- m:
+			default:
+				p.mu.Unlock()
+				select {
+				case out <- m:
+				case <-g.done:
+					return
+				}
+				p.mu.Lock()
+			}
+			now := time.Now()
+			if !sent.IsZero() {
+				p.queue.get(w).add(now.Sub(sent))
+			}
+			p.received[g] = now
+			p.mu.Unlock()
+		}
+	}()
+	return out
+}
+
+// Called when a gadget sends out a message, returns a function to call once
+// the send has completed.
+func (p *profile) sending(g *Gadget) func() {
+	start := time.Now()
+	p.mu.Lock()
+	if t, ok := p.received[g]; ok {
+		p.process.get(g).add(start.Sub(t))
+		delete(p.received, g) // only the first send after each message counts
+	}
+	p.mu.Unlock()
+	return func() {
+		d := time.Since(start)
+		p.mu.Lock()
+		p.send.get(g).add(d)
+		p.mu.Unlock()
+	}
+}
+
+// Histograms for gadgets or wires, must only be used with the lock held.
+type histograms map[interface{}]*histogram
+
+func (hs histograms) get(key interface{}) *histogram {
+	if hs[key] == nil {
+		hs[key] = &histogram{}
+	}
+	return hs[key]
+}
+
+// A histogram counts durations in buckets which double in size, from one
+// microsecond up.
+type histogram struct {
+	buckets [40]int
+	count   int
+	total   time.Duration
+	max     time.Duration
+}
+
+func (h *histogram) add(d time.Duration) {
+	i := 0
+	for limit := time.Microsecond; d >= limit && i < len(h.buckets)-1; limit *= 2 {
+		i++
+	}
+	h.buckets[i]++
+	h.count++
+	h.total += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Estimate a percentile, as the upper bound of the bucket it falls in.
+func (h *histogram) percentile(q float64) time.Duration {
+	n := 0
+	limit := time.Microsecond
+	for _, b := range h.buckets {
+		n += b
+		if float64(n) >= q*float64(h.count) {
+			break
+		}
+		limit *= 2
+	}
+	if limit > h.max {
+		limit = h.max
+	}
+	return limit
+}
+
+// A ProfileEntry summarises the measurements of one kind for one gadget, or
+// for one input pin in the case of "queue". Percentiles are estimates.
+type ProfileEntry struct {
+	Kind  string        `json:"kind"` // "process", "send", or "queue"
+	Name  string        `json:"name"` // e.g. "sub.c", or "sub.c.In"
+	Count int           `json:"count"`
+	Total time.Duration `json:"total"`
+	Max   time.Duration `json:"max"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+}
+
+// Profile returns the measurements collected since EnableProfiling, with the
+// highest total time first.
+func (c *Circuit) Profile() []ProfileEntry {
+	entries := []ProfileEntry{}
+	p := c.profile
+	if p == nil {
+		return entries
+	}
+	add := func(kind, name string, h *histogram) {
+		if h != nil && h.count > 0 {
+			entries = append(entries, ProfileEntry{kind, name, h.count, h.total,
+				h.max, h.percentile(0.5), h.percentile(0.9), h.percentile(0.99)})
+		}
+	}
+	c.eachGadget("", func(info *gadgetInfo) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		add("process", info.path, p.process[info.gadget])
+		add("send", info.path, p.send[info.gadget])
+		for _, in := range info.inputs {
+			add("queue", info.path+"."+in.pin, p.queue[in.wire])
+		}
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Total > entries[j].Total
+	})
+	return entries
+}
+
+// WriteProfile writes the results of Profile as a table.
+func (c *Circuit) WriteProfile(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "kind\tname\tcount\ttotal\tmax\tp50\tp90\tp99\t")
+	for _, e := range c.Profile() {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%v\t%v\t%v\t%v\t\n",
+			e.Kind, e.Name, e.Count, e.Total, e.Max, e.P50, e.P90, e.P99)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,55 @@
+package flow_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func TestProfile(t *testing.T) {
+	g := flow.NewCircuit()
+	g.Add("r", "Repeater")
+	g.AddCircuitry("s", flow.Transformer(func(m flow.Message) flow.Message {
+		time.Sleep(5 * time.Millisecond)
+		return m
+	}))
+	g.Add("c", "Counter")
+	g.Connect("r.Out", "s.In", 10)
+	g.Connect("s.Out", "c.In", 0)
+	g.Feed("r.Num", 5)
+	g.Feed("r.In", "abc")
+	g.EnableProfiling()
+	g.Run()
+
+	entries := g.Profile()
+	found := map[string]flow.ProfileEntry{}
+	for i, e := range entries {
+		found[e.Kind+" "+e.Name] = e
+		if i > 0 && e.Total > entries[i-1].Total {
+			t.Errorf("not sorted by total: %v", entries)
+		}
+	}
+	if e := found["process s"]; e.Count != 5 || e.Total < 25*time.Millisecond ||
+		e.P50 < 5*time.Millisecond || e.Max < e.P50 {
+		t.Errorf("unexpected processing time: %+v", e)
+	}
+	if e := found["queue s.In"]; e.Count != 5 || e.Total < 50*time.Millisecond {
+		t.Errorf("unexpected queue time: %+v", e)
+	}
+	if e := found["process r"]; e.Count > 1 {
+		t.Errorf("only the first send should count: %+v", e)
+	}
+	if e := found["send r"]; e.Count != 5 {
+		t.Errorf("unexpected send time: %+v", e)
+	}
+
+	var buf bytes.Buffer
+	flow.Check(g.WriteProfile(&buf))
+	if !strings.Contains(buf.String(), "queue  s.In") {
+		t.Errorf("unexpected report:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,127 @@
+package flow
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// A RateLimit shapes the traffic on a wire with a token bucket: on average,
+// Rate messages per second can pass, with bursts of up to Burst messages. When
+// the limit is reached, senders are held up, or with Drop set, the message is
+// discarded. Either way, this is counted in the stats of the wire, and dropped
+// messages do not count as sent. Reload can change the limit of a running wire.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+	Drop  bool
+}
+
+// ConnectLimited connects an output pin with an input pin, like Connect, but
+// limits the rate at which messages can be sent to the input pin.
+func (c *Circuit) ConnectLimited(from, to string, capacity int, limit RateLimit) {
+	c.connect(wireDef{From: from, To: to, Capacity: capacity,
+		Rate: limit.Rate, Burst: limit.Burst, Drop: limit.Drop})
+}
+
+// Return the rate limit of a wire definition, if any.
+func (wd *wireDef) rateLimit() *RateLimit {
+	if wd.Rate <= 0 {
+		return nil
+	}
+	return &RateLimit{wd.Rate, wd.Burst, wd.Drop}
+}
+
+// Limit the rate of a wire, or remove the limit if it is nil. While setting up
+// the circuit, a second, different limit for the same input is ignored. Once
+// the receiver is running, as with Reload, the limit is replaced by a fresh
+// token bucket, which applies from the next message sent.
+func (c *wire) limit(limit *RateLimit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.rateLimiter()
+	switch {
+	case limit == nil && old == nil:
+	case old != nil && limit != nil && old.limit == *limit:
+	case old != nil && limit != nil && !c.dest.launched:
+		glog.Warningln("input already has a rate limit, ignoring:", limit)
+	case limit == nil:
+		c.limiter.Store((*tokenBucket)(nil))
+	default:
+		c.limiter.Store(newTokenBucket(*limit))
+	}
+}
+
+// Return the token bucket of a wire, or nil if it has no rate limit.
+func (c *wire) rateLimiter() *tokenBucket {
+	b, _ := c.limiter.Load().(*tokenBucket)
+	return b
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	b := &tokenBucket{limit: limit, last: time.Now()}
+	b.tokens = b.burst()
+	return b
+}
+
+func (b *tokenBucket) burst() float64 {
+	if b.limit.Burst < 1 {
+		return 1
+	}
+	return float64(b.limit.Burst)
+}
+
+// Take a token, and return how long to wait before it may be used. Returns
+// false if the message should be dropped instead, no token is taken then.
+func (b *tokenBucket) reserve() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if b.limit.Drop {
+		return 0, false
+	}
+	b.tokens-- // it will be paid back in the future, so the wait is fair
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second)), true
+}
+
+// Wait until a message may be sent on a rate limited wire. Returns errDropped
+// if the message must be dropped.
+func (g *Gadget) throttle(w *wire, b *tokenBucket, retired chan struct{}) error {
+	wait, ok := b.reserve()
+	if !ok {
+		atomic.AddUint64(&w.dropped, 1)
+		return errDropped
+	}
+	if wait <= 0 {
+		return nil
+	}
+	atomic.AddUint64(&w.limited, 1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-g.owner.abort:
+		return ErrClosedOutput
+	case <-retired:
+		return errRetired
+	}
+}
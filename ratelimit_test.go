@@ -0,0 +1,130 @@
+package flow_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+// Counts the messages it receives.
+type rateCount struct {
+	flow.Gadget
+	In flow.Input
+
+	n int
+}
+
+func (g *rateCount) Run() {
+	for range g.In {
+		g.n++
+	}
+}
+
+func TestConnectLimited(t *testing.T) {
+	count := new(rateCount)
+	g := flow.NewCircuit()
+	g.Add("r", "Repeater")
+	g.AddCircuitry("c", count)
+	g.ConnectLimited("r.Out", "c.In", 0, flow.RateLimit{Rate: 100, Burst: 2})
+	g.Feed("r.Num", 6)
+	g.Feed("r.In", "abc")
+	start := time.Now()
+	g.Run()
+
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("rate limit not applied, took only %v", elapsed)
+	}
+	if count.n != 6 {
+		t.Errorf("expected 6 messages, got %d", count.n)
+	}
+	for _, w := range g.Stats().Wires {
+		if w.To == "c.In" && (w.Limited < 3 || w.Dropped != 0) {
+			t.Errorf("unexpected stats: %+v", w)
+		}
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	count := new(rateCount)
+	g := flow.NewCircuit()
+	g.AddCircuitry("c", count)
+	err := g.LoadJSONStrict([]byte(`{
+		"gadgets": [{ "name": "r", "type": "Repeater" }],
+		"wires": [{ "from": "r.Out", "to": "c.In", "rate": 1, "burst": 2, "drop": true }],
+		"feeds": [{ "data": "abc", "to": "r.In" }]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Feed("r.Num", 5)
+	g.Run()
+
+	if count.n != 2 {
+		t.Errorf("expected 2 messages, got %d", count.n)
+	}
+	var buf bytes.Buffer
+	flow.Check(g.WriteMetrics(&buf))
+	if !strings.Contains(buf.String(), `flow_rate_dropped_total{circuit="",gadget="c",pin="In"} 3`) {
+		t.Errorf("dropped messages not in metrics:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `flow_messages_out_total{circuit="",gadget="r",pin="Out"} 2`) {
+		t.Errorf("dropped messages counted as sent:\n%s", buf.String())
+	}
+
+	err = flow.NewCircuit().LoadJSON([]byte(`{
+		"gadgets": [{ "name": "r", "type": "Repeater" }],
+		"wires": [{ "from": "r.Out", "to": "r.In", "drop": true }]
+	}`))
+	if err == nil || !strings.Contains(err.Error(), "need a rate") {
+		t.Errorf("expected an error for drop without rate, got: %v", err)
+	}
+}
+
+func TestReloadRateLimit(t *testing.T) {
+	reloadSource = make(chan flow.Message)
+
+	def := `{
+		"gadgets": [
+			{ "name": "src", "type": "TestSource" },
+			{ "name": "col", "type": "TestCollect" }
+		],
+		"wires": [ { "from": "src.Out", "to": "col.In", "rate": %s, "drop": true } ]
+	}`
+	g := flow.NewCircuit()
+	if err := g.LoadJSON([]byte(fmt.Sprintf(def, "0.001"))); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		g.Run()
+		close(done)
+	}()
+
+	reloadSource <- "a"
+	reloadSource <- "b" // dropped, there is only one token
+	expectResults(t, "a")
+	for start := time.Now(); g.Stats().Wires[0].Dropped != 1; {
+		if time.Since(start) > time.Second {
+			t.Fatal("message was not dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := g.Reload([]byte(fmt.Sprintf(def, "1000"))); err != nil {
+		t.Fatal(err)
+	}
+	reloadSource <- "c"
+	expectResults(t, "c")
+
+	close(reloadSource)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("circuit did not finish")
+	}
+}
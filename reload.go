@@ -0,0 +1,436 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Changes lists what a call to Reload did to a circuit. Wires are listed as
+// "from -> to", labels as "external = internal" (or "-external" if removed).
+type Changes struct {
+	Added        []string `json:"added,omitempty"`        // new gadgets
+	Removed      []string `json:"removed,omitempty"`      // dropped gadgets
+	Restarted    []string `json:"restarted,omitempty"`    // replaced by a new instance
+	Connected    []string `json:"connected,omitempty"`    // new wires
+	Disconnected []string `json:"disconnected,omitempty"` // dropped wires
+	Fed          []string `json:"fed,omitempty"`          // pins with new feeds
+	Labels       []string `json:"labels,omitempty"`       // changed labels
+}
+
+// Return true if the reload did not change anything.
+func (ch *Changes) Empty() bool {
+	return len(ch.Added)+len(ch.Removed)+len(ch.Restarted)+len(ch.Connected)+
+		len(ch.Disconnected)+len(ch.Fed)+len(ch.Labels) == 0
+}
+
+// Summarise the changes on a single line, for use in log messages.
+func (ch *Changes) String() string {
+	if ch.Empty() {
+		return "no changes"
+	}
+	parts := []string{}
+	add := func(what string, list []string) {
+		if len(list) > 0 {
+			parts = append(parts, what+": "+strings.Join(list, ", "))
+		}
+	}
+	add("added", ch.Added)
+	add("removed", ch.Removed)
+	add("restarted", ch.Restarted)
+	add("connected", ch.Connected)
+	add("disconnected", ch.Disconnected)
+	add("fed", ch.Fed)
+	add("labels", ch.Labels)
+	return strings.Join(parts, "; ")
+}
+
+// Reload compares a new JSON definition with the current one, and applies the
+// differences. Gadgets which are not affected keep running. A gadget is
+// restarted as a new instance when its type changes, when a feed to an input
+// which has already been consumed changes, or when a wire is added to an input
+// which has already been closed. Removed gadgets are told to stop, see Aborted.
+// The labels of a sub-circuit which is already wired up are re-targeted to their
+// new internal pins. Gadgets added with AddCircuitry are left alone, since they
+// cannot be re-created from the definition.
+func (c *Circuit) Reload(data []byte) (*Changes, error) {
+	var raw config
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return c.reload(&raw)
+}
+
+// ReloadRegistered is like Reload, but uses the definition of a circuit type
+// in the registry, as added by AddToRegistry from a file in any format.
+func (c *Circuit) ReloadRegistered(typ string) (*Changes, error) {
+	def := definitions[typ]
+	if def == nil {
+		return nil, fmt.Errorf("cannot reload, no such circuit: %s", typ)
+	}
+	raw, err := def.decode()
+	if err != nil {
+		return nil, err
+	}
+	return c.reload(raw)
+}
+
+// Apply the differences with a decoded definition, see Reload.
+func (c *Circuit) reload(raw *config) (*Changes, error) {
+	r := newParamResolver(c.params, raw.Params)
+	conf := r.config(raw, "")
+	if len(r.errs) > 0 {
+		return nil, r.errs
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running {
+		// old instances may end before the new ones have been launched
+		c.wait.Add(1)
+		defer c.wait.Done()
+	}
+
+	// collect the new definition in the same form as the current one
+	defs := []gadgetDef{}
+	for _, def := range conf.Gadgets {
+		if def.Replicas <= 1 {
+			def.Replicas, def.Ordered = 0, false
+		}
+		if def.Circuit == nil && Registry[def.Type] == nil {
+			return nil, fmt.Errorf("cannot reload, no such gadget: %s", def.Type)
+		}
+		defs = append(defs, def)
+	}
+	wires := conf.Wires
+	feeds := map[string][]Message{}
+	timed := map[string][]timedFeed{}
+	for _, f := range conf.Feeds {
+		var m Message = f.Data
+		if f.Tag != "" {
+			m = Tag{f.Tag, f.Data}
+		}
+		if s, _ := f.schedule(); s != nil {
+			timed[f.To] = append(timed[f.To], timedFeed{*s, m})
+		} else {
+			feeds[f.To] = append(feeds[f.To], m)
+		}
+	}
+	labels := map[string]string{}
+	for _, l := range conf.Labels {
+		labels[l.External] = l.Internal
+	}
+
+	ch := &Changes{}
+
+	// figure out which gadgets are new, changed, or gone
+	oldDefs := map[string]gadgetDef{}
+	for _, d := range c.gnames {
+		oldDefs[d.Name] = d
+	}
+	newDefs := map[string]gadgetDef{}
+	fresh := map[string]bool{} // gadgets which need a new instance
+	for _, d := range defs {
+		newDefs[d.Name] = d
+		if old, ok := oldDefs[d.Name]; !ok {
+			ch.Added = append(ch.Added, d.Name)
+			fresh[d.Name] = true
+		} else if !reflect.DeepEqual(old, d) {
+			ch.Restarted = append(ch.Restarted, d.Name)
+			fresh[d.Name] = true
+		}
+	}
+	removed := map[string]bool{}
+	for _, d := range c.gnames {
+		if _, ok := newDefs[d.Name]; !ok {
+			ch.Removed = append(ch.Removed, d.Name)
+			removed[d.Name] = true
+		}
+	}
+	exists := func(name string) bool {
+		_, registered := oldDefs[name]
+		return newDefs[name].Name != "" || !registered && c.gadgets[name] != nil
+	}
+	pins := []string{}
+	for _, w := range wires {
+		pins = append(pins, w.From, w.To)
+	}
+	for _, in := range labels {
+		pins = append(pins, in)
+	}
+	for _, pin := range pins {
+		if !strings.Contains(pin, ".") || !exists(gadgetPart(pin)) {
+			return nil, fmt.Errorf("cannot reload, gadget not found for: %s", pin)
+		}
+	}
+	kept := func(name string) bool {
+		return c.gadgets[name] != nil && !fresh[name] && !removed[name]
+	}
+	restart := func(name string) {
+		if newDefs[name].Name == "" {
+			glog.Warningln("cannot restart unregistered gadget:", name)
+		} else if !fresh[name] {
+			fresh[name] = true
+			ch.Restarted = append(ch.Restarted, name)
+		}
+	}
+
+	// figure out which wires are new or gone
+	oldWires := map[wireDef]bool{}
+	for _, w := range c.wires {
+		oldWires[w] = true
+	}
+	newWires := map[wireDef]bool{}
+	newFrom := map[string]bool{}
+	for _, w := range wires {
+		newWires[w] = true
+		newFrom[w.From] = true
+		if !oldWires[w] {
+			ch.Connected = append(ch.Connected, w.From+" -> "+w.To)
+			// a running gadget can't get a new input once it has been closed,
+			// nor a new entry in an output map, so it needs to be restarted
+			to, pin := gadgetPart(w.To), pinPart(w.To)
+			if kept(to) && c.gadgets[to].launched {
+				if in := c.gadgets[to].inputs[pin]; in == nil || !in.isOpen() {
+					restart(to)
+				}
+			}
+			from, pin := gadgetPart(w.From), pinPart(w.From)
+			if kept(from) && c.gadgets[from].launched &&
+				c.gadgets[from].outputs[pin] == nil {
+				restart(from)
+			}
+		}
+	}
+	for _, w := range c.wires {
+		if !newWires[w] {
+			ch.Disconnected = append(ch.Disconnected, w.From+" -> "+w.To)
+		}
+	}
+
+	// new feeds are sent to open inputs, else the gadget has to be restarted
+	inject := map[string][]Message{}
+	for pin, msgs := range feeds {
+		old := c.feeds[pin]
+		if reflect.DeepEqual(old, msgs) {
+			continue
+		}
+		ch.Fed = append(ch.Fed, pin)
+		name := gadgetPart(pin)
+		if !kept(name) || !c.gadgets[name].launched {
+			continue
+		}
+		in := c.gadgets[name].inputs[pinPart(pin)]
+		if in != nil && in.isOpen() && len(old) < len(msgs) &&
+			reflect.DeepEqual(old, msgs[:len(old)]) {
+			inject[pin] = msgs[len(old):]
+		} else {
+			restart(name)
+		}
+	}
+	for pin := range c.feeds {
+		if _, ok := feeds[pin]; !ok {
+			ch.Fed = append(ch.Fed, pin)
+		}
+	}
+
+	// changed timed feeds take effect when the gadget is restarted
+	timedPins := map[string]bool{}
+	for pin := range timed {
+		timedPins[pin] = true
+	}
+	for pin := range c.timed {
+		timedPins[pin] = true
+	}
+	for pin := range timedPins {
+		if reflect.DeepEqual(c.timed[pin], timed[pin]) {
+			continue
+		}
+		ch.Fed = append(ch.Fed, pin)
+		if name := gadgetPart(pin); kept(name) && c.gadgets[name].launched {
+			restart(name)
+		}
+	}
+
+	// if this is a sub-circuit which has been wired up, a label which points to
+	// another input needs a fresh gadget there, which can still be given the wire
+	for ext, in := range labels {
+		name := gadgetPart(in)
+		if old := c.labels[ext]; old == "" || old == in || !kept(name) ||
+			!c.gadgets[name].launched {
+			continue
+		}
+		if h, _ := c.external(ext, true); h != nil && h.launched {
+			restart(name)
+		}
+	}
+	// labels which point elsewhere, or to a new instance, have to be re-targeted
+	relabel := []string{}
+	for ext, in := range labels {
+		if old := c.labels[ext]; old != "" && (old != in || fresh[gadgetPart(in)]) {
+			relabel = append(relabel, ext)
+		}
+	}
+
+	// replace the instances of all fresh gadgets, and drop the removed ones
+	retired := []*Gadget{}
+	for _, name := range ch.Removed {
+		retired = append(retired, c.gadgets[name])
+		delete(c.gadgets, name)
+	}
+	for name := range fresh {
+		if g := c.gadgets[name]; g != nil {
+			retired = append(retired, g)
+		}
+		d := newDefs[name]
+		switch {
+		case d.Circuit != nil:
+			sub := NewCircuit()
+			sub.loadConfig(d.Circuit)
+			c.AddCircuitry(name, sub)
+		case d.Replicas > 1:
+			c.AddCircuitry(name, newPool(d.Type, d.Replicas, d.Ordered))
+		case d.Params != nil && definitions[d.Type] != nil:
+			c.AddCircuitry(name, newWithParams(definitions[d.Type], d.Params))
+		default:
+			c.AddCircuitry(name, Registry[d.Type]())
+		}
+	}
+
+	// set up all the wires which are new, or which lead to a fresh gadget
+	for _, w := range wires {
+		if oldWires[w] && !fresh[gadgetPart(w.From)] && !fresh[gadgetPart(w.To)] {
+			continue
+		}
+		in := c.gadgetOf(w.To).getInput(pinPart(w.To), w.Capacity)
+		if w.Durable != "" {
+			in.makeDurable(w.Durable)
+		}
+		in.limit(w.rateLimit()) // replaces or removes a changed rate limit
+		src, pin := c.gadgetOf(w.From), pinPart(w.From)
+		if o := src.outputs[pin]; o != nil {
+			o.moveTo(in) // this is a running gadget, just re-target its output
+		} else {
+			src.setOutput(pin, in)
+		}
+	}
+	// disconnect outputs which no longer go anywhere
+	for _, w := range c.wires {
+		src := c.gadgets[gadgetPart(w.From)]
+		if !newWires[w] && !newFrom[w.From] && src != nil && kept(src.name) {
+			if o := src.outputs[pinPart(w.From)]; o != nil {
+				o.moveTo(nil)
+			}
+		}
+	}
+	for _, ext := range relabel {
+		c.relabel(ext, labels[ext])
+	}
+	// stop the old instances, this closes their outbound wires
+	for _, g := range retired {
+		g.remove()
+	}
+
+	// feeds only take effect for new connections and instances
+	for ext, in := range labels {
+		if c.labels[ext] != in {
+			ch.Labels = append(ch.Labels, ext+" = "+in)
+		}
+	}
+	for ext := range c.labels {
+		if _, ok := labels[ext]; !ok {
+			ch.Labels = append(ch.Labels, "-"+ext)
+		}
+	}
+	c.labels = labels
+	c.feeds = feeds
+	c.timed = timed
+	c.gnames = defs
+	c.wires = wires
+
+	// start the fresh gadgets, if the circuit is already running
+	for name := range fresh {
+		if c.running {
+			c.gadgets[name].launch()
+		}
+	}
+	for pin, msgs := range inject {
+		in := c.gadgetOf(pin).inputs[pinPart(pin)]
+		in.connect() // keeps the input open until all messages have been sent
+		go func(in *wire, msgs []Message) {
+			defer in.Disconnect()
+			for _, m := range msgs {
+				in.Send(m)
+			}
+		}(in, msgs)
+	}
+
+	for _, list := range [][]string{ch.Added, ch.Removed, ch.Restarted,
+		ch.Connected, ch.Disconnected, ch.Fed, ch.Labels} {
+		sort.Strings(list)
+	}
+	glog.Infoln("reloaded:", ch)
+	return ch, nil
+}
+
+// Return the gadget and pin which hold the wire or outlet of an external pin of
+// this circuit, following labels up through the circuits it is nested in. This
+// is only set up once the circuit has been wired up as a sub-circuit.
+func (c *Circuit) external(ext string, input bool) (*Gadget, string) {
+	if input && c.inputs[ext] != nil || !input && c.outputs[ext] != nil {
+		return &c.Gadget, ext
+	}
+	if p := c.owner; p != nil {
+		for pext, internal := range p.labels {
+			if internal == c.name+"."+ext {
+				return p.external(pext, input)
+			}
+		}
+	}
+	return nil, ""
+}
+
+// Re-target an external pin of a sub-circuit to a new internal pin. An input
+// gets a new wire, to which all its senders are moved, which closes the old one.
+// An output sends to the same wire as before, but from the new internal pin.
+func (c *Circuit) relabel(ext, internal string) {
+	g, pin := c.gadgetOf(internal), pinPart(internal)
+	if h, p := c.external(ext, true); h != nil && h.launched {
+		w := h.inputs[p]
+		in := g.getInput(pin, w.capacity)
+		h.owner.mu.Lock()
+		for _, x := range h.owner.gadgets {
+			for _, o := range x.outputs {
+				if o.target() == w {
+					o.moveTo(in)
+				}
+			}
+		}
+		h.owner.mu.Unlock()
+		h.inputs[p] = in
+	}
+	if h, p := c.external(ext, false); h != nil {
+		o := h.outputs[p]
+		w := o.target()
+		if w == nil || strings.Contains(pin, ":") {
+			return
+		}
+		fv := g.circuitry.pinValue(pin)
+		n, _ := fv.Interface().(*outlet)
+		switch {
+		case fv.IsNil():
+			g.setOutput(pin, w)
+			n = g.outputs[pin]
+		case n != nil && n.target() == nil && !n.isClosed():
+			n.moveTo(w) // a running gadget, with its output not connected yet
+		default:
+			glog.Warningln("cannot re-target label, already connected:", internal)
+			return
+		}
+		h.outputs[p] = n
+		o.moveTo(nil)
+	}
+}
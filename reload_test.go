@@ -0,0 +1,255 @@
+package flow_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+// feeds messages into a circuit from the test, until the channel is closed
+var reloadSource chan flow.Message
+
+// collects messages from a circuit, and counts how often it was created
+var reloadResults = make(chan flow.Message, 10)
+var reloadCollectors int
+
+type testSource struct {
+	flow.Gadget
+	Out flow.Output
+}
+
+func (g *testSource) Run() {
+	for m := range reloadSource {
+		g.Out.Send(m)
+	}
+}
+
+type testCollect struct {
+	flow.Gadget
+	In flow.Input
+}
+
+func (g *testCollect) Run() {
+	for m := range g.In {
+		reloadResults <- m
+	}
+}
+
+func init() {
+	flow.Registry["TestSource"] = func() flow.Circuitry { return new(testSource) }
+	flow.Registry["TestCollect"] = func() flow.Circuitry {
+		reloadCollectors++
+		return new(testCollect)
+	}
+}
+
+func expectResults(t *testing.T, want ...flow.Message) {
+	for _, w := range want {
+		select {
+		case m := <-reloadResults:
+			if m != w {
+				t.Errorf("expected %v, got %v", w, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %v", w)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	reloadSource = make(chan flow.Message)
+	reloadCollectors = 0
+
+	g := flow.NewCircuit()
+	err := g.LoadJSON([]byte(`{
+		"gadgets": [
+			{ "name": "src", "type": "TestSource" },
+			{ "name": "a", "type": "Pipe" },
+			{ "name": "col", "type": "TestCollect" }
+		],
+		"wires": [
+			{ "from": "src.Out", "to": "a.In" },
+			{ "from": "a.Out", "to": "col.In" }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		g.Run()
+		close(done)
+	}()
+
+	reloadSource <- "abc"
+	expectResults(t, "abc")
+
+	changes, err := g.Reload([]byte(`{
+		"gadgets": [
+			{ "name": "src", "type": "TestSource" },
+			{ "name": "b", "type": "AddTag" },
+			{ "name": "col", "type": "TestCollect" }
+		],
+		"wires": [
+			{ "from": "src.Out", "to": "b.In" },
+			{ "from": "b.Out", "to": "col.In" }
+		],
+		"feeds": [
+			{ "data": "new", "to": "b.Tag" }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &flow.Changes{
+		Added:        []string{"b"},
+		Removed:      []string{"a"},
+		Connected:    []string{"b.Out -> col.In", "src.Out -> b.In"},
+		Disconnected: []string{"a.Out -> col.In", "src.Out -> a.In"},
+		Fed:          []string{"b.Tag"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected changes: %s", changes)
+	}
+
+	reloadSource <- "def"
+	expectResults(t, flow.Tag{"new", "def"})
+
+	if reloadCollectors != 1 {
+		t.Errorf("collector was created %d times", reloadCollectors)
+	}
+
+	close(reloadSource)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("circuit did not finish")
+	}
+}
+
+func TestReloadErrors(t *testing.T) {
+	g := flow.NewCircuit()
+	g.Add("p", "Pipe")
+	if _, err := g.Reload([]byte(`{"gadgets": [{"name": "x", "type": "Nope"}]}`)); err == nil {
+		t.Error("expected error for unknown gadget type")
+	}
+	if _, err := g.Reload([]byte(`{"wires": [{"from": "p.Out", "to": "q.In"}]}`)); err == nil {
+		t.Error("expected error for unknown gadget in wire")
+	}
+	changes, err := g.Reload([]byte(`{"gadgets": [{"name": "p", "type": "Pipe"}]}`))
+	if err != nil || !changes.Empty() {
+		t.Errorf("expected no changes, got: %v %v", changes, err)
+	}
+}
+
+func TestReloadLabels(t *testing.T) {
+	reloadSource = make(chan flow.Message)
+
+	sub := flow.NewCircuit()
+	err := sub.LoadJSON([]byte(`{
+		"gadgets": [
+			{ "name": "a", "type": "Pipe" },
+			{ "name": "b", "type": "AddTag" }
+		],
+		"feeds": [
+			{ "data": "x", "to": "b.Tag" }
+		],
+		"labels": [
+			{ "external": "In", "internal": "a.In" },
+			{ "external": "Out", "internal": "a.Out" }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := flow.NewCircuit()
+	g.Add("src", "TestSource")
+	g.AddCircuitry("sub", sub)
+	g.Add("col", "TestCollect")
+	g.Connect("src.Out", "sub.In", 0)
+	g.Connect("sub.Out", "col.In", 0)
+	done := make(chan struct{})
+	go func() {
+		g.Run()
+		close(done)
+	}()
+
+	reloadSource <- "abc"
+	expectResults(t, "abc")
+
+	changes, err := sub.Reload([]byte(`{
+		"gadgets": [
+			{ "name": "a", "type": "Pipe" },
+			{ "name": "b", "type": "AddTag" }
+		],
+		"feeds": [
+			{ "data": "x", "to": "b.Tag" }
+		],
+		"labels": [
+			{ "external": "In", "internal": "b.In" },
+			{ "external": "Out", "internal": "b.Out" }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &flow.Changes{
+		Restarted: []string{"b"},
+		Labels:    []string{"In = b.In", "Out = b.Out"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected changes: %s", changes)
+	}
+
+	reloadSource <- "def"
+	expectResults(t, flow.Tag{"x", "def"})
+
+	close(reloadSource)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("circuit did not finish")
+	}
+}
+
+func TestReloadRemoveSource(t *testing.T) {
+	g := flow.NewCircuit()
+	err := g.LoadJSON([]byte(`{
+		"gadgets": [
+			{ "name": "clk", "type": "Clock" },
+			{ "name": "s", "type": "Sink" }
+		],
+		"wires": [
+			{ "from": "clk.Out", "to": "s.In" }
+		],
+		"feeds": [
+			{ "data": "10ms", "to": "clk.In" }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		g.Run()
+		close(done)
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	_, err = g.Reload([]byte(`{
+		"gadgets": [
+			{ "name": "s", "type": "Sink" }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("circuit did not finish")
+	}
+}
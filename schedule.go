@@ -0,0 +1,114 @@
+package flow
+
+import (
+	"fmt"
+	"time"
+)
+
+// A Schedule tells when a timed feed is sent: after a delay from the start of
+// the circuit, or at a specific time if At is set. With Every set, the message
+// is then sent again and again, until the circuit is aborted.
+type Schedule struct {
+	After time.Duration
+	At    time.Time
+	Every time.Duration
+}
+
+// A message to be sent to an input pin once the circuit has started.
+type timedFeed struct {
+	Schedule
+	msg Message
+}
+
+// FeedAfter sets up a message to send to a gadget some time after it starts.
+func (c *Circuit) FeedAfter(pin string, m Message, delay time.Duration) {
+	c.FeedScheduled(pin, m, Schedule{After: delay})
+}
+
+// FeedScheduled sets up a message to send to a gadget on a schedule. The input
+// pin stays open until the last message has been sent, so with a repeating
+// schedule, it only gets closed when the circuit is aborted.
+func (c *Circuit) FeedScheduled(pin string, m Message, s Schedule) {
+	if c.timed == nil {
+		c.timed = map[string][]timedFeed{}
+	}
+	c.timed[pin] = append(c.timed[pin], timedFeed{s, m})
+}
+
+// Send a timed feed to a wire in the background. The feed counts as sender,
+// so that the wire is not closed before it is done.
+func (g *Gadget) sendScheduled(w *wire, f timedFeed) {
+	w.connect()
+	go func() {
+		defer w.Disconnect()
+		delay := f.After
+		if !f.At.IsZero() {
+			delay = time.Until(f.At)
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-g.owner.abort:
+				return
+			case <-g.done:
+				return
+			case <-g.removed:
+				return
+			}
+			if g.sendTo(w, f.msg, nil) != nil || f.Every <= 0 {
+				return
+			}
+			timer.Reset(f.Every)
+		}
+	}()
+}
+
+// Return the schedule of a feed definition, or nil if it is not timed.
+func (f *feedDef) schedule() (*Schedule, error) {
+	if f.After == "" && f.At == "" && f.Every == "" {
+		return nil, nil
+	}
+	var s Schedule
+	var err error
+	if f.After != "" && f.At != "" {
+		return nil, fmt.Errorf("feed can't have both \"after\" and \"at\"")
+	}
+	if f.After != "" {
+		if s.After, err = time.ParseDuration(f.After); err != nil {
+			return nil, err
+		}
+	}
+	if f.At != "" {
+		if s.At, err = time.Parse(time.RFC3339, f.At); err != nil {
+			return nil, err
+		}
+	}
+	if f.Every != "" {
+		if s.Every, err = time.ParseDuration(f.Every); err != nil {
+			return nil, err
+		}
+		if s.Every <= 0 {
+			return nil, fmt.Errorf("repeat interval must be positive: %s", f.Every)
+		}
+	}
+	return &s, nil
+}
+
+// Describe a timed feed in the same form as in a definition.
+func (f *timedFeed) describe(pin string) feedDef {
+	fd := feedDef{Data: f.msg, To: pin}
+	if t, ok := f.msg.(Tag); ok {
+		fd.Tag, fd.Data = t.Tag, t.Msg
+	}
+	if !f.At.IsZero() {
+		fd.At = f.At.Format(time.RFC3339Nano)
+	} else {
+		fd.After = f.After.String()
+	}
+	if f.Every > 0 {
+		fd.Every = f.Every.String()
+	}
+	return fd
+}
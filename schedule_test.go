@@ -0,0 +1,87 @@
+package flow_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func ExampleCircuit_FeedAfter() {
+	g := flow.NewCircuit()
+	g.Add("p", "Printer")
+	g.FeedAfter("p.In", "later", 10*time.Millisecond)
+	g.Feed("p.In", "now")
+	g.Run()
+	// Output:
+	// now
+	// later
+}
+
+// Records when each message arrives, and aborts after a given number.
+type scheduleTake struct {
+	flow.Gadget
+	In flow.Input
+
+	n     int
+	times []time.Duration
+}
+
+func (g *scheduleTake) Run() {
+	start := time.Now()
+	for range g.In {
+		g.times = append(g.times, time.Since(start))
+		if len(g.times) == g.n {
+			g.Abort()
+		}
+	}
+}
+
+func TestFeedScheduled(t *testing.T) {
+	take := &scheduleTake{n: 3}
+	g := flow.NewCircuit()
+	g.AddCircuitry("t", take)
+	g.FeedScheduled("t.In", 1, flow.Schedule{After: 20 * time.Millisecond,
+		Every: 10 * time.Millisecond})
+	g.Run() // only returns because the repeating feed stops on abort
+
+	if len(take.times) != 3 || take.times[0] < 20*time.Millisecond ||
+		take.times[2] < 40*time.Millisecond {
+		t.Errorf("unexpected arrival times: %v", take.times)
+	}
+}
+
+func TestTimedFeedsJSON(t *testing.T) {
+	g := flow.NewCircuit()
+	err := g.LoadJSONStrict([]byte(`{
+		"gadgets": [{ "name": "p", "type": "Printer" }],
+		"feeds": [
+			{ "data": "x", "to": "p.In", "after": "5ms" },
+			{ "data": "y", "to": "p.In", "at": "2030-01-02T03:04:05Z", "every": "1h" }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(g.Describe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := string(out)
+	for _, s := range []string{`"after":"5ms"`, `"at":"2030-01-02T03:04:05Z"`, `"every":"1h0m0s"`} {
+		if !strings.Contains(data, s) {
+			t.Errorf("missing %s in description: %s", s, data)
+		}
+	}
+
+	err = flow.NewCircuit().LoadJSON([]byte(`{
+		"gadgets": [{ "name": "p", "type": "Printer" }],
+		"feeds": [{ "data": "x", "to": "p.In", "after": "soon" }]
+	}`))
+	if err == nil || !strings.Contains(err.Error(), "invalid schedule") {
+		t.Errorf("expected an invalid schedule error, got: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The JSON Schema for setup files, i.e. objects with named circuit definitions.
+// This must match the "schema.json" file published with this package.
+const coreSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/jcw/flow/schema.json",
+  "title": "Flow setup file",
+  "description": "Named circuit definitions, as used by AddToRegistry.",
+  "type": "object",
+  "properties": {
+    "import": {
+      "description": "Other setup files to load, relative to this one.",
+      "type": "array",
+      "items": { "$ref": "#/definitions/import" }
+    }
+  },
+  "additionalProperties": { "$ref": "#/definitions/circuit" },
+  "definitions": {
+    "import": {
+      "anyOf": [
+        { "type": "string" },
+        {
+          "type": "object",
+          "additionalProperties": false,
+          "required": [ "file" ],
+          "properties": {
+            "file": { "type": "string" },
+            "optional": { "type": "boolean" }
+          }
+        }
+      ]
+    },
+    "circuit": {
+      "description": "A circuit definition, as used by LoadJSON.",
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "gadgets": { "type": "array", "items": { "$ref": "#/definitions/gadget" } },
+        "wires": { "type": "array", "items": { "$ref": "#/definitions/wire" } },
+        "feeds": { "type": "array", "items": { "$ref": "#/definitions/feed" } },
+        "labels": { "type": "array", "items": { "$ref": "#/definitions/label" } },
+        "unregistered": { "type": "array", "items": { "type": "string" } },
+        "params": { "$ref": "#/definitions/params" }
+      }
+    },
+    "gadget": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": [ "name" ],
+      "properties": {
+        "name": { "$ref": "#/definitions/name" },
+        "type": { "$ref": "#/definitions/gadgetType" },
+        "replicas": { "type": "integer", "minimum": 0 },
+        "ordered": { "type": "boolean" },
+        "circuit": { "$ref": "#/definitions/circuit" },
+        "params": { "$ref": "#/definitions/params" }
+      }
+    },
+    "wire": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": [ "from", "to" ],
+      "properties": {
+        "from": { "$ref": "#/definitions/pin" },
+        "to": { "$ref": "#/definitions/pin" },
+        "capacity": { "type": "integer", "minimum": 0 },
+        "durable": { "type": "string" },
+        "rate": { "type": "number", "minimum": 0 },
+        "burst": { "type": "integer", "minimum": 0 },
+        "drop": { "type": "boolean" }
+      }
+    },
+    "feed": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": [ "to" ],
+      "properties": {
+        "tag": { "type": "string" },
+        "data": {},
+        "to": { "$ref": "#/definitions/pin" },
+        "after": { "type": "string" },
+        "at": { "type": "string" },
+        "every": { "type": "string" }
+      }
+    },
+    "label": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": [ "external", "internal" ],
+      "properties": {
+        "external": { "$ref": "#/definitions/name" },
+        "internal": { "$ref": "#/definitions/pin" }
+      }
+    },
+    "name": { "type": "string", "pattern": "^[^.]+$" },
+    "pin": { "type": "string", "pattern": "^[^.]+\\..+$" },
+    "gadgetType": { "type": "string" },
+    "params": { "type": "object", "additionalProperties": { "type": "string" } }
+  }
+}`
+
+// JSONSchema returns the JSON Schema for setup files. It extends the published
+// schema with the names of all gadget types in the registry, and lists the
+// pins of each of them under "x-pins".
+func JSONSchema() []byte {
+	schema := schemaWithRegistry()
+	data, err := json.MarshalIndent(schema, "", "  ")
+	Check(err)
+	return data
+}
+
+// The schema with the registry is only built again if the registry changed.
+var schemaCache struct {
+	sync.Mutex
+	key    string
+	schema map[string]interface{}
+}
+
+// Return the schema with the registry, it must not be modified.
+func schemaWithRegistry() map[string]interface{} {
+	key := []string{}
+	for _, name := range registryNames() {
+		key = append(key, fmt.Sprintf("%s:%x:%p",
+			name, reflect.ValueOf(Registry[name]).Pointer(), definitions[name]))
+	}
+	schemaCache.Lock()
+	defer schemaCache.Unlock()
+	if k := strings.Join(key, " "); k != schemaCache.key || schemaCache.schema == nil {
+		schemaCache.key, schemaCache.schema = k, buildSchema()
+	}
+	return schemaCache.schema
+}
+
+func buildSchema() map[string]interface{} {
+	var schema map[string]interface{}
+	Check(json.Unmarshal([]byte(coreSchema), &schema))
+	types := []interface{}{}
+	pins := map[string]interface{}{}
+	for _, name := range registryNames() {
+		types = append(types, name)
+		pins[name], _ = typePins(name)
+	}
+	defs := schema["definitions"].(map[string]interface{})
+	defs["gadgetType"].(map[string]interface{})["enum"] = types
+	schema["x-pins"] = pins
+	return schema
+}
+
+func registryNames() []string {
+	names := []string{}
+	for name := range Registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load a circuit from a JSON description, like LoadJSON, but first validate
+// it against the JSON Schema. Unknown fields, such as a misspelled "capcity",
+// are reported as errors instead of being ignored.
+func (c *Circuit) LoadJSONStrict(data []byte) error {
+	d := jsonDefinition("", data, 0)
+	if err := validateJSON(d, data); err != nil {
+		return err
+	}
+	return c.loadDefinition(d)
+}
+
+// Validate a definition against the schema, if it can be converted to JSON.
+func (d *definition) validate() error {
+	if d.asJSON == nil {
+		return nil
+	}
+	data, err := d.asJSON()
+	if err != nil {
+		return err
+	}
+	return validateJSON(d, data)
+}
+
+// Validate one circuit definition against the schema.
+func validateJSON(d *definition, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return jsonError(d.file, data, 0, err)
+	}
+	v := &schemaValidator{root: schemaWithRegistry()}
+	v.validate(v.resolve("#/definitions/circuit"), value, "")
+	for _, e := range v.errs {
+		e.File = d.file
+		e.Line = d.lineOf(strings.ToLower(e.Path))
+	}
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// A schemaValidator supports the subset of JSON Schema used for definitions.
+type schemaValidator struct {
+	root map[string]interface{}
+	errs DefinitionErrors
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, &DefinitionError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Look up a reference of the form "#/definitions/name".
+func (v *schemaValidator) resolve(ref string) map[string]interface{} {
+	node := v.root
+	for _, key := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		node = node[key].(map[string]interface{})
+	}
+	return node
+}
+
+func (v *schemaValidator) validate(schema map[string]interface{}, value interface{}, path string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema = v.resolve(ref)
+	}
+	if typ, ok := schema["type"].(string); ok && !schemaType(typ, value) {
+		v.fail(path, "expected %s, got: %s", typ, jsonText(value))
+		return
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == value
+		}
+		if !found {
+			v.fail(path, "unknown value: %s", jsonText(value))
+		}
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if s, _ := value.(string); !regexp.MustCompile(pattern).MatchString(s) {
+			v.fail(path, "invalid value: %s", jsonText(value))
+		}
+	}
+	if min, ok := schema["minimum"].(float64); ok {
+		if n, err := value.(json.Number).Float64(); err == nil && n < min {
+			v.fail(path, "must be at least %v, got: %s", min, value)
+		}
+	}
+	switch value := value.(type) {
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case map[string]interface{}:
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := value[r.(string)]; !ok {
+				v.fail(path, "missing field: %s", r)
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		keys := []string{}
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			sub := key
+			if path != "" {
+				sub = path + "." + key
+			}
+			if p, ok := props[key].(map[string]interface{}); ok {
+				v.validate(p, value[key], sub)
+			} else if extra, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				v.validate(extra, value[key], sub)
+			} else if schema["additionalProperties"] == false {
+				v.fail(sub, "unknown field")
+			}
+		}
+	}
+}
+
+// Return true if a decoded JSON value is of the specified type.
+func schemaType(typ string, value interface{}) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return typ == "object"
+	case []interface{}:
+		return typ == "array"
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case json.Number:
+		_, err := value.Int64()
+		return typ == "number" || (typ == "integer" && err == nil)
+	}
+	return typ == "null"
+}
+
+func jsonText(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
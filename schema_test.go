@@ -0,0 +1,106 @@
+package flow_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jcw/flow"
+	_ "github.com/jcw/flow/gadgets"
+)
+
+func TestJSONSchema(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(flow.JSONSchema(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	pins := schema["x-pins"].(map[string]interface{})
+	if !reflect.DeepEqual(pins["Repeater"], []interface{}{"In", "Num", "Out"}) {
+		t.Errorf("unexpected pins for Repeater: %v", pins["Repeater"])
+	}
+
+	// without the registry details, it should match the published schema
+	delete(schema, "x-pins")
+	defs := schema["definitions"].(map[string]interface{})
+	delete(defs["gadgetType"].(map[string]interface{}), "enum")
+	data, err := ioutil.ReadFile("schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var published map[string]interface{}
+	if err := json.Unmarshal(data, &published); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(schema, published) {
+		t.Error("schema.json does not match JSONSchema")
+	}
+}
+
+func TestLoadJSONStrict(t *testing.T) {
+	tests := []struct{ data, want string }{
+		{`{ "gadgets": [ { "name": "p", "type": "Pipe" } ] }`, ""},
+		{`{ "wirse": [] }`, "line 1: wirse: unknown field"},
+		{`{
+			"gadgets": [ { "name": "p", "type": "Pipe" } ],
+			"wires": [
+				{ "from": "p.Out", "to": "p.In", "capcity": 1 }
+			]
+		}`, "line 4: wires[0].capcity: unknown field"},
+		{`{ "gadgets": [ { "name": "p", "type": "Nope" } ] }`,
+			`line 1: gadgets[0].type: unknown value: "Nope"`},
+		{`{ "wires": [ { "from": "p.Out", "capacity": 1.5 } ] }`,
+			"wires[0]: missing field: to\nline 1: wires[0].capacity: expected integer, got: 1.5"},
+		{`{ "gadgets": [ { "name": "p", "type": "Pipe" }, { "name": "p", "type": "Pipe" } ] }`,
+			"line 1: gadgets[1]: duplicate gadget name: p"},
+	}
+	for i, test := range tests {
+		err := flow.NewCircuit().LoadJSONStrict([]byte(test.data))
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%d: expected %q, got: %v", i, test.want, err)
+		}
+	}
+}
+
+func TestAddToRegistryStrict(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"setup.json": `{
+			"import": [ "more.yaml" ],
+			"strictA": {
+				"gadgets": [ { "name": "p", "type": "Pipe" } ],
+				"wirse": []
+			}
+		}`,
+		"more.yaml": "strictB:\n  gadgets:\n    - name: p\n      type: Pipe\n      replica: 2\n",
+	})
+	defer os.RemoveAll(dir)
+
+	setup := filepath.Join(dir, "setup.json")
+	if err := flow.AddToRegistry(setup); err != nil {
+		t.Fatal(err)
+	}
+	flow.RemoveFromRegistry("strictA", "strictB")
+
+	err := flow.AddToRegistryStrict(setup)
+	errs, ok := err.(flow.DefinitionErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", err)
+	}
+	for i, want := range []string{
+		"line 5: strictB.gadgets[0].replica: unknown field",
+		"line 5: strictA.wirse: unknown field",
+	} {
+		if !strings.HasSuffix(errs[i].Error(), want) {
+			t.Errorf("expected %q, got: %v", want, errs[i])
+		}
+	}
+	if flow.Registry["strictA"] != nil {
+		t.Error("registry should be left as is")
+	}
+}
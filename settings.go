@@ -0,0 +1,370 @@
+package flow
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration holds the application settings, as set up by LoadConfig.
+var Configuration = NewSettings()
+
+// Settings is a set of configuration values, collected from several layers.
+// Later layers override earlier ones: defaults, then files in the order in
+// which they were added, then environment variables, then command-line flags,
+// and finally values passed to Set. It is safe for concurrent use.
+type Settings struct {
+	mu        sync.RWMutex
+	defaults  map[string]string
+	files     []*settingsFile
+	envPrefix string
+	noEnv     bool
+	flags     map[string]string
+	explicit  map[string]string
+	listeners []*func(changed []string)
+}
+
+type settingsFile struct {
+	name   string
+	values map[string]string
+	mtime  time.Time
+}
+
+// A SettingError reports a missing or malformed configuration value.
+type SettingError struct {
+	Key   string
+	Value string
+	Err   error
+}
+
+func (e *SettingError) Error() string {
+	if e.Err == nil {
+		return "setting not found: " + e.Key
+	}
+	return fmt.Sprintf("setting %s=%q: %v", e.Key, e.Value, e.Err)
+}
+
+// Create a new empty set of configuration values.
+func NewSettings() *Settings {
+	return &Settings{
+		defaults: map[string]string{},
+		flags:    map[string]string{},
+		explicit: map[string]string{},
+	}
+}
+
+// Parse lines of the form "KEY = VALUE", skipping empty lines and comments.
+func parseSettings(r io.Reader, source string) (map[string]string, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) == "" {
+			return nil, fmt.Errorf("%s: line %d: cannot parse configuration: %s",
+				source, n, line)
+		}
+		values[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+	}
+	return values, scanner.Err()
+}
+
+// Update the settings while locked, and report all the keys which changed.
+func (s *Settings) update(change func()) {
+	s.mu.Lock()
+	before := s.all()
+	change()
+	after := s.all()
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	changed := []string{}
+	for k, v := range after {
+		if old, ok := before[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		for _, fn := range listeners {
+			(*fn)(changed)
+		}
+	}
+}
+
+// SetDefaults adds default values, given as "KEY = VALUE" lines.
+func (s *Settings) SetDefaults(text string) error {
+	values, err := parseSettings(strings.NewReader(text), "defaults")
+	if err != nil {
+		return err
+	}
+	s.update(func() {
+		for k, v := range values {
+			s.defaults[k] = v
+		}
+	})
+	return nil
+}
+
+// AddFile adds a layer of values from a file with "KEY = VALUE" lines. Adding
+// the same file again re-reads it. Use os.IsNotExist to check for a missing
+// file, the other settings remain usable in that case.
+func (s *Settings) AddFile(filename string) error {
+	f, err := s.readFile(filename)
+	if err != nil {
+		return err
+	}
+	s.update(func() {
+		for i, old := range s.files {
+			if old.name == filename {
+				s.files[i] = f
+				return
+			}
+		}
+		s.files = append(s.files, f)
+	})
+	return nil
+}
+
+func (s *Settings) readFile(filename string) (*settingsFile, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseSettings(fd, filename)
+	if err != nil {
+		return nil, err
+	}
+	return &settingsFile{filename, values, info.ModTime()}, nil
+}
+
+// SetEnvPrefix sets the prefix for environment variables which override a
+// setting, e.g. with prefix "FLOW_", "FLOW_APP_DIR" overrides "APP_DIR". The
+// default is no prefix. Empty environment variables are ignored.
+func (s *Settings) SetEnvPrefix(prefix string) {
+	s.update(func() { s.envPrefix = prefix })
+}
+
+// UseEnv enables or disables overriding settings from the environment.
+func (s *Settings) UseEnv(enabled bool) {
+	s.update(func() { s.noEnv = !enabled })
+}
+
+// SetFlags uses all the flags which were set on the command line as settings.
+// Flag names are converted to keys by changing them to upper case and using
+// underscores instead of dashes, i.e. "-app-dir" sets "APP_DIR".
+func (s *Settings) SetFlags(fs *flag.FlagSet) {
+	s.update(func() {
+		fs.Visit(func(f *flag.Flag) {
+			key := strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+			s.flags[key] = f.Value.String()
+		})
+	})
+}
+
+// Set a value, overriding all other layers.
+func (s *Settings) Set(key, value string) {
+	s.update(func() { s.explicit[key] = value })
+}
+
+// OnChange registers a function to call with the keys of all changed values.
+// It is called after each change, including files re-read by WatchFiles.
+// Call the returned function to remove it again.
+func (s *Settings) OnChange(fn func(changed []string)) (remove func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := &fn
+	s.listeners = append(s.listeners, p)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		listeners := []*func(changed []string){}
+		for _, l := range s.listeners {
+			if l != p {
+				listeners = append(listeners, l)
+			}
+		}
+		s.listeners = listeners
+	}
+}
+
+// WatchFiles checks all files for modifications at the given interval, and
+// re-reads those which have changed. Files which fail to parse are left as
+// is, errors are passed to the optional report function. Call the returned
+// function to stop watching.
+func (s *Settings) WatchFiles(interval time.Duration, report func(error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			s.mu.RLock()
+			files := append([]*settingsFile{}, s.files...)
+			s.mu.RUnlock()
+			for _, f := range files {
+				info, err := os.Stat(f.name)
+				if err == nil && info.ModTime().Equal(f.mtime) {
+					continue
+				}
+				if err == nil {
+					err = s.AddFile(f.name)
+				}
+				if err != nil && report != nil {
+					report(err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Look up a value, the caller must hold the lock.
+func (s *Settings) get(key string) (string, bool) {
+	if v, ok := s.explicit[key]; ok {
+		return v, true
+	}
+	if v, ok := s.flags[key]; ok {
+		return v, true
+	}
+	value, found := s.defaults[key]
+	for _, f := range s.files {
+		if v, ok := f.values[key]; ok {
+			value, found = v, true
+		}
+	}
+	if found && !s.noEnv {
+		if v := os.Getenv(s.envPrefix + key); v != "" {
+			value = v
+		}
+	}
+	return value, found
+}
+
+// Return all current values, the caller must hold the lock.
+func (s *Settings) all() map[string]string {
+	keys := map[string]bool{}
+	for _, m := range []map[string]string{s.defaults, s.flags, s.explicit} {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	for _, f := range s.files {
+		for k := range f.values {
+			keys[k] = true
+		}
+	}
+	values := map[string]string{}
+	for k := range keys {
+		values[k], _ = s.get(k)
+	}
+	return values
+}
+
+// Get returns a value, and whether it has been set at all.
+func (s *Settings) Get(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(key)
+}
+
+// Keys returns the sorted names of all settings.
+func (s *Settings) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := []string{}
+	for k := range s.all() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// All returns a copy of all current values.
+func (s *Settings) All() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.all()
+}
+
+// String returns a value, or the fallback if it has not been set.
+func (s *Settings) String(key, fallback string) string {
+	if v, ok := s.Get(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// Look up a value and convert it, reporting what went wrong if it can't be.
+func (s *Settings) convert(key string, fn func(string) error) error {
+	v, ok := s.Get(key)
+	if !ok {
+		return &SettingError{Key: key}
+	}
+	if err := fn(v); err != nil {
+		return &SettingError{key, v, err}
+	}
+	return nil
+}
+
+// Int returns a value as integer.
+func (s *Settings) Int(key string) (n int, err error) {
+	err = s.convert(key, func(v string) (err error) {
+		n, err = strconv.Atoi(v)
+		return
+	})
+	return
+}
+
+// Bool returns a value as boolean, i.e. "1", "t", "true", "0", "f", "false".
+func (s *Settings) Bool(key string) (b bool, err error) {
+	err = s.convert(key, func(v string) (err error) {
+		b, err = strconv.ParseBool(v)
+		return
+	})
+	return
+}
+
+// Duration returns a value as time duration, such as "1.5s" or "10m".
+func (s *Settings) Duration(key string) (d time.Duration, err error) {
+	err = s.convert(key, func(v string) (err error) {
+		d, err = time.ParseDuration(v)
+		return
+	})
+	return
+}
+
+// Paths returns a list of paths, separated as in the PATH environment variable.
+func (s *Settings) Paths(key string) (paths []string, err error) {
+	err = s.convert(key, func(v string) error {
+		paths = filepath.SplitList(v)
+		return nil
+	})
+	return
+}
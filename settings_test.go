@@ -0,0 +1,120 @@
+package flow_test
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcw/flow"
+)
+
+func ExampleSettings() {
+	s := flow.NewSettings()
+	s.SetDefaults(`
+		# defaults
+		PORT = 8080
+		DEBUG = false
+		TIMEOUT = 1.5s
+	`)
+	s.Set("DEBUG", "true")
+
+	port, _ := s.Int("PORT")
+	debug, _ := s.Bool("DEBUG")
+	timeout, _ := s.Duration("TIMEOUT")
+	fmt.Println(port, debug, timeout)
+	_, err := s.Int("NOPE")
+	fmt.Println(err)
+	// Output:
+	// 8080 true 1.5s
+	// setting not found: NOPE
+}
+
+func TestSettingsLayers(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.conf":   "A = file-a\nB = file-a\nC = file-a\n",
+		"b.conf":   "B = file-b\nPATHS = /x" + string(filepath.ListSeparator) + "/y\n",
+		"bad.conf": "A = 1\noops\n",
+	})
+	defer os.RemoveAll(dir)
+
+	os.Setenv("FLOWTEST_C", "env")
+	defer os.Unsetenv("FLOWTEST_C")
+
+	s := flow.NewSettings()
+	s.SetEnvPrefix("FLOWTEST_")
+	s.SetDefaults("A = default\nD = default")
+	for _, name := range []string{"a.conf", "b.conf"} {
+		if err := s.AddFile(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("d", "", "")
+	fs.Parse([]string{"-d", "flag"})
+	s.SetFlags(fs)
+
+	expected := map[string]string{
+		"A": "file-a", "B": "file-b", "C": "env", "D": "flag",
+		"PATHS": "/x" + string(filepath.ListSeparator) + "/y",
+	}
+	if !reflect.DeepEqual(s.All(), expected) {
+		t.Errorf("unexpected settings: %v", s.All())
+	}
+	if paths, _ := s.Paths("PATHS"); !reflect.DeepEqual(paths, []string{"/x", "/y"}) {
+		t.Errorf("unexpected paths: %v", paths)
+	}
+	if _, err := s.Int("A"); err == nil || !strings.Contains(err.Error(), `setting A="file-a"`) {
+		t.Errorf("expected conversion error, got: %v", err)
+	}
+	err := s.AddFile(filepath.Join(dir, "bad.conf"))
+	if err == nil || !strings.Contains(err.Error(), "bad.conf: line 2: cannot parse") {
+		t.Errorf("expected parse error, got: %v", err)
+	}
+	if err := s.AddFile(filepath.Join(dir, "missing.conf")); !os.IsNotExist(err) {
+		t.Errorf("expected missing file, got: %v", err)
+	}
+}
+
+func TestSettingsWatch(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"app.conf": "A = 1\nB = 2\n"})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.conf")
+
+	s := flow.NewSettings()
+	if err := s.AddFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan []string, 10)
+	remove := s.OnChange(func(keys []string) { changes <- keys })
+	stop := s.WatchFiles(10*time.Millisecond, func(err error) { t.Error(err) })
+	defer stop()
+
+	ioutil.WriteFile(filename, []byte("A = 1\nB = 3\nC = 4\n"), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(filename, later, later) // make sure the change is noticed
+	select {
+	case keys := <-changes:
+		if !reflect.DeepEqual(keys, []string{"B", "C"}) {
+			t.Errorf("unexpected changes: %v", keys)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("change not noticed")
+	}
+	if v, _ := s.Get("B"); v != "3" {
+		t.Errorf("expected new value, got: %s", v)
+	}
+
+	remove()
+	s.Set("D", "5")
+	select {
+	case keys := <-changes:
+		t.Errorf("removed listener was called: %v", keys)
+	default:
+	}
+}
@@ -0,0 +1,270 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes the current activity in a circuit and its sub-circuits.
+type Stats struct {
+	Gadgets []GadgetStats `json:"gadgets"`
+	Wires   []WireStats   `json:"wires"`
+}
+
+// GadgetStats describes one gadget, sub-circuits are listed as well.
+type GadgetStats struct {
+	Name  string `json:"name"`  // full path, e.g. "sub.c"
+	Type  string `json:"type"`  // Go type of the gadget
+	State string `json:"state"` // "waiting", "running", or "done"
+}
+
+// WireStats describes the messages sent to one input pin.
+type WireStats struct {
+	To       string   `json:"to"`             // full path, e.g. "sub.c.In"
+	From     []string `json:"from,omitempty"` // output pins connected to it
+	Sent     uint64   `json:"sent"`           // number of messages sent so far
+	Queued   int      `json:"queued"`         // messages waiting to be received
+	Capacity int      `json:"capacity"`
+	Durable  string   `json:"durable,omitempty"`
+	Closed   bool     `json:"closed"`
+	Limited  uint64   `json:"limited,omitempty"` // sends held up by the rate limit
+	Dropped  uint64   `json:"dropped,omitempty"` // messages over the rate limit
+}
+
+// Stats returns a snapshot of the activity in this circuit.
+func (c *Circuit) Stats() *Stats {
+	s := &Stats{Gadgets: []GadgetStats{}, Wires: []WireStats{}}
+	c.collectStats("", s)
+	return s
+}
+
+// A consistent view of one gadget, as collected by eachGadget.
+type gadgetInfo struct {
+	circuit string // path of the circuit it is in, "" at the top
+	name    string
+	path    string // full path, e.g. "sub.c"
+	gadget  *Gadget
+	state   string
+	inputs  []pinInfo
+	outputs []pinInfo
+}
+
+type pinInfo struct {
+	pin  string
+	wire *wire    // for inputs
+	from []string // for inputs, the output pins connected to it
+	out  *outlet  // for outputs
+}
+
+// Call a function for all gadgets in this circuit and its sub-circuits.
+func (c *Circuit) eachGadget(prefix string, fn func(*gadgetInfo)) {
+	c.mu.Lock()
+	names := []string{}
+	for name := range c.gadgets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	from := map[string][]string{}
+	for _, w := range c.wires {
+		from[w.To] = append(from[w.To], prefix+w.From)
+	}
+	infos := []*gadgetInfo{}
+	for _, name := range names {
+		g := c.gadgets[name]
+		info := &gadgetInfo{
+			circuit: strings.TrimSuffix(prefix, "."),
+			name:    name,
+			path:    prefix + name,
+			gadget:  g,
+			state:   g.state(),
+		}
+		for pin, w := range g.inputs {
+			if strings.Contains(pin, ".") {
+				pin = pinPart(pin) // inputs for feeds use the full pin name
+			}
+			info.inputs = append(info.inputs,
+				pinInfo{pin: pin, wire: w, from: from[name+"."+pin]})
+		}
+		for pin, o := range g.outputs {
+			info.outputs = append(info.outputs, pinInfo{pin: pin, out: o})
+		}
+		sortPins(info.inputs)
+		sortPins(info.outputs)
+		infos = append(infos, info)
+	}
+	c.mu.Unlock()
+
+	for _, info := range infos {
+		fn(info)
+		if sub, ok := info.gadget.circuitry.(*Circuit); ok {
+			sub.eachGadget(info.path+".", fn)
+		}
+	}
+}
+
+func sortPins(pins []pinInfo) {
+	sort.Slice(pins, func(i, j int) bool { return pins[i].pin < pins[j].pin })
+}
+
+func (c *Circuit) collectStats(prefix string, s *Stats) {
+	c.eachGadget(prefix, func(info *gadgetInfo) {
+		typ := fmt.Sprintf("%T", info.gadget.circuitry)
+		s.Gadgets = append(s.Gadgets,
+			GadgetStats{info.path, strings.TrimPrefix(typ, "*"), info.state})
+		for _, in := range info.inputs {
+			w := in.wire
+			w.mu.Lock()
+			s.Wires = append(s.Wires, WireStats{
+				To:       info.path + "." + in.pin,
+				From:     in.from,
+				Sent:     atomic.LoadUint64(&w.sent),
+				Queued:   len(w.channel),
+				Capacity: w.capacity,
+				Durable:  w.durable,
+				Closed:   w.closed,
+				Limited:  atomic.LoadUint64(&w.limited),
+				Dropped:  atomic.LoadUint64(&w.dropped),
+			})
+			w.mu.Unlock()
+		}
+	})
+}
+
+// Return the state of a gadget, the caller must hold the owner's lock.
+func (g *Gadget) state() string {
+	if g.done == nil {
+		return "waiting"
+	}
+	select {
+	case <-g.done:
+		return "done"
+	default:
+		return "running"
+	}
+}
+
+// Look up the wire into an input pin, such as "c.In" or "sub.c.In".
+func (c *Circuit) findInput(pin string) (*wire, error) {
+	if !strings.Contains(pin, ".") {
+		return nil, fmt.Errorf("not a pin: %s", pin)
+	}
+	name, rest := gadgetPart(pin), pin[len(gadgetPart(pin))+1:]
+	c.mu.Lock()
+	g := c.gadgets[name]
+	var w *wire
+	if g != nil {
+		w = g.inputs[rest]
+	}
+	c.mu.Unlock()
+	if g == nil {
+		return nil, fmt.Errorf("gadget not found for: %s", pin)
+	}
+	if w == nil {
+		// the wire can also lead to this circuit, through a label
+		for ext, internal := range c.labels {
+			if internal == pin && c.inputs[ext] != nil {
+				w = c.inputs[ext]
+			}
+		}
+	}
+	sub, isCircuit := g.circuitry.(*Circuit)
+	if isCircuit && strings.Contains(rest, ".") {
+		return sub.findInput(rest)
+	}
+	if w != nil {
+		return w, nil
+	}
+	if isCircuit && sub.labels[rest] != "" {
+		return sub.findInput(sub.labels[rest])
+	}
+	return nil, fmt.Errorf("input not connected: %s", pin)
+}
+
+// Inject sends a message to an input pin of a running circuit, such as "c.In"
+// or "sub.c.In". The pin must still be connected to some other gadget.
+func (c *Circuit) Inject(pin string, m Message) error {
+	w, err := c.findInput(pin)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosedOutput
+	}
+	w.senders++ // keeps the wire open while sending
+	w.mu.Unlock()
+	defer w.Disconnect()
+	return w.dest.sendTo(w, m, nil)
+}
+
+// Tap returns a channel with a copy of each message sent to an input pin, such
+// as "c.In" or "sub.c.In". Messages are dropped if they are not read quickly
+// enough, so that tapping never slows down the circuit. The channel is closed
+// when the wire is closed or the circuit finishes. Call the returned function
+// to stop tapping.
+func (c *Circuit) Tap(pin string) (<-chan Message, func(), error) {
+	w, err := c.findInput(pin)
+	if err != nil {
+		return nil, nil, err
+	}
+	tap := make(chan Message, 100)
+	w.mu.Lock()
+	if w.closed {
+		close(tap) // nothing more will be sent
+	} else {
+		w.taps = append(w.taps, tap)
+		atomic.AddInt32(&w.ntaps, 1)
+	}
+	w.mu.Unlock()
+	stop := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for i, t := range w.taps {
+			if t == tap {
+				w.taps = append(w.taps[:i:i], w.taps[i+1:]...)
+				atomic.AddInt32(&w.ntaps, -1)
+				close(tap)
+			}
+		}
+	}
+	return tap, stop, nil
+}
+
+// Keep track of a message which has been sent on this wire.
+func (c *wire) delivered(m Message) {
+	atomic.AddUint64(&c.sent, 1)
+	if atomic.LoadInt32(&c.ntaps) > 0 {
+		c.mu.Lock()
+		for _, tap := range c.taps {
+			select {
+			case tap <- m:
+			default: // drop it, the tap is not keeping up
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Shutdown waits until all messages in the wires of the circuit have been
+// picked up, and then aborts it. Returns false if that did not happen within
+// the timeout, in which case the circuit is aborted anyway.
+func (c *Circuit) Shutdown(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	idle := false
+	for !idle && time.Now().Before(deadline) {
+		idle = true
+		for _, w := range c.Stats().Wires {
+			if w.Queued > 0 {
+				idle = false
+				time.Sleep(10 * time.Millisecond)
+				break
+			}
+		}
+	}
+	c.Abort()
+	return idle
+}